@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fuba/histree-core/pkg/histree"
+)
+
+// parseTimeFlag parses an absolute time (RFC3339, "2006-01-02T15:04:05" or
+// "2006-01-02" in local time) or a duration such as "90m", which is taken
+// as that long before now. An empty value yields the zero time.
+func parseTimeFlag(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: use RFC3339, YYYY-MM-DD or a duration such as 1h", value)
+}
+
+// parseStartFlag parses a command start time given as Unix seconds with an
+// optional fraction (such as zsh's $EPOCHREALTIME) or as RFC3339
+func parseStartFlag(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if secs, err := strconv.ParseFloat(value, 64); err == nil {
+		whole := int64(secs)
+		t := time.Unix(whole, int64((secs-float64(whole))*1e9)).UTC()
+		return &t, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		t = t.UTC()
+		return &t, nil
+	}
+	return nil, fmt.Errorf("invalid start time %q: use Unix seconds or RFC3339", value)
+}
+
+// parseSortKey parses the -sort flag
+func parseSortKey(value string) (histree.SortKey, error) {
+	switch value {
+	case "time", "":
+		return histree.SortTime, nil
+	case "duration":
+		return histree.SortDuration, nil
+	case "frecency":
+		return histree.SortFrecency, nil
+	default:
+		return 0, fmt.Errorf("invalid sort key %q: use time, duration or frecency", value)
+	}
+}
+
+// parseExitCodes parses a comma-separated list of exit codes
+func parseExitCodes(value string) ([]int, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var codes []int
+	for _, field := range strings.Split(value, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid exit code %q", field)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// parseOrder parses the -order flag
+func parseOrder(value string) (histree.Order, error) {
+	switch value {
+	case "asc", "":
+		return histree.OrderOldestFirst, nil
+	case "desc":
+		return histree.OrderNewestFirst, nil
+	default:
+		return 0, fmt.Errorf("invalid order %q: use asc or desc", value)
+	}
+}
+
+// parseRepoFlag resolves the -repo flag to the value matched by
+// Query.Repository. Directories are resolved to the repository containing
+// them; anything else, such as a remote URL, is used as is.
+func parseRepoFlag(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	info, err := os.Stat(value)
+	if err != nil || !info.IsDir() {
+		return value, nil
+	}
+
+	repo, err := histree.DetectRepository(value)
+	if err != nil {
+		return "", err
+	}
+	if repo == nil {
+		return "", fmt.Errorf("%s is not inside a git repository", value)
+	}
+	return repo.ID(), nil
+}
+
+// parseScope parses the -scope flag. The global scope clears the directory
+// filter; an empty value keeps the subtree default.
+func parseScope(value string) (mode histree.DirMode, global bool, err error) {
+	switch value {
+	case "subtree", "":
+		return histree.DirSubtree, false, nil
+	case "dir":
+		return histree.DirExact, false, nil
+	case "project":
+		return histree.DirProject, false, nil
+	case "ancestors":
+		return histree.DirAncestors, false, nil
+	case "global":
+		return histree.DirSubtree, true, nil
+	default:
+		return 0, false, fmt.Errorf("invalid scope %q: use dir, subtree, project, ancestors or global", value)
+	}
+}
+
+// parseList parses a comma-separated list, returning nil for an empty value
+func parseList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -1,31 +1,80 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/fuba/histree-core/pkg/histree"
+	"github.com/fuba/histree-core/pkg/importer"
 )
 
+// formatTemplate is the output format defined by the -template flag
+const formatTemplate histree.OutputFormat = "template"
+
 func main() {
 	version := flag.Bool("version", false, "Show version information")
 	dbPath := flag.String("db", "", "Path to SQLite database (required)")
-	action := flag.String("action", "", "Action to perform: add, get, or update-path")
-	limit := flag.Int("limit", 100, "Number of entries to retrieve")
+	action := flag.String("action", "", "Action to perform: add, get, search, update-path, undo-path, reconcile, suggest, import, alias-add, alias-list, alias-remove, session-start, or session-end")
+	limit := flag.Int("limit", 100, "Number of entries to retrieve (0 for all)")
 	currentDir := flag.String("dir", "", "Current directory for filtering entries")
-	format := flag.String("format", string(histree.FormatSimple), "Output format: json, simple, or verbose")
+	format := flag.String("format", string(histree.FormatSimple), "Output format: json, json-array, simple, verbose, csv, tsv, null (NUL-terminated commands), html, markdown, template (see -template), or a shell history file format: zsh, bash or fish")
+	entryTemplate := flag.String("template", "", "Go text/template written for each entry with -format template, e.g. '{{.Timestamp.Local | date \"15:04\"}} {{.Command}}'")
 	hostname := flag.String("hostname", "", "Hostname (required for add action)")
-	processID := flag.Int("pid", 0, "Process ID (required for add action)")
+	processID := flag.Int("pid", 0, "Process ID (required for add action; filters entries for get)")
 	verbose := flag.Bool("v", false, "Show verbose output (same as -format verbose)")
 	exitCode := flag.Int("exit", 0, "Exit code of the command")
-	oldPath := flag.String("old-path", "", "Old directory path (required for update-path action)")
-	newPath := flag.String("new-path", "", "New directory path (required for update-path action)")
+	oldPath := flag.String("old-path", "", "Old directory path (required for update-path; the alias for alias-add and alias-remove)")
+	newPath := flag.String("new-path", "", "New directory path (required for update-path; the canonical path for alias-add)")
+	searchText := flag.String("q", "", "Search text (required for search action)")
+	from := flag.String("from", "", "History format to import: bash, zsh, fish or atuin (required for import action)")
+	file := flag.String("file", "", "History file to import (default: the format's usual location)")
+	prefix := flag.String("prefix", "", "Only suggest commands starting with this text (suggest action)")
+	host := flag.String("host", "", "Only get entries recorded on this host (for reconcile, the host whose directories are checked; default: this machine)")
+	exactDir := flag.Bool("exact-dir", false, "Only get entries recorded in -dir itself, not its subdirectories (same as -scope dir)")
+	scope := flag.String("scope", "subtree", "Which entries get returns for -dir: dir (the directory only), subtree (it and its subdirectories), project (the whole project containing it), ancestors (it and its parents, nearest first) or global (everything)")
+	rootMarkers := flag.String("root-markers", strings.Join(histree.DefaultRootMarkers, ","), "Comma-separated files or directories marking a project root for -scope project")
+	since := flag.String("since", "", "Only get entries at or after this time (RFC3339, YYYY-MM-DD, or a duration ago such as 1h)")
+	until := flag.String("until", "", "Only get entries before this time (RFC3339, YYYY-MM-DD, or a duration ago such as 1h)")
+	failed := flag.Bool("failed", false, "Only get commands that exited with a non-zero code")
+	exitCodes := flag.String("exit-codes", "", "Only get commands that exited with one of these comma-separated codes")
+	contains := flag.String("contains", "", "Only get commands containing this substring")
+	regex := flag.String("regex", "", "Only get commands matching this regular expression")
+	glob := flag.String("glob", "", "Only get commands matching this glob pattern")
+	offset := flag.Int("offset", 0, "Number of most recent matching entries to skip")
+	order := flag.String("order", "asc", "Output order for get: asc (oldest or shortest first) or desc (newest or longest first)")
+	immutable := flag.Bool("immutable", false, "Treat the database as unchangeable read-only media, e.g. a snapshot (get and search actions)")
+	migrate := flag.Bool("migrate", false, "Upgrade an outdated database schema before reading it, backing it up first (get, search and suggest actions)")
+	sessionID := flag.String("session", "", "Session ID to record with add, scope get to, or end with session-end")
+	shell := flag.String("shell", "", "Shell name for session-start (default: base name of $SHELL)")
+	tty := flag.String("tty", "", "Terminal device for session-start")
+	userName := flag.String("user", "", "User name for session-start (default: $USER)")
+	startTime := flag.String("start", "", "Time the command started, as Unix seconds (e.g. $EPOCHREALTIME) or RFC3339 (add action)")
+	duration := flag.Duration("duration", 0, "How long the command ran, e.g. 1500ms (add action)")
+	minDuration := flag.Duration("min-duration", 0, "Only get commands that ran at least this long")
+	maxDuration := flag.Duration("max-duration", 0, "Only get commands that ran at most this long")
+	sortBy := flag.String("sort", "time", "Rank get results by: time, duration or frecency (implies -unique)")
+	unique := flag.Bool("unique", false, "Only get the latest occurrence of each command")
+	dryRun := flag.Bool("dry-run", false, "Print the directories update-path or reconcile would change without changing them")
+	roots := flag.String("root", "", "Directories searched by reconcile for moved directories, separated by the OS path list separator (default: $HOME)")
+	yes := flag.Bool("yes", false, "Apply every move found by reconcile without asking")
+	detectGit := flag.Bool("git", true, "Record the git repository of the directory, found by looking for .git upwards (add action)")
+	repoRoot := flag.String("repo-root", "", "Git repository root to record instead of detecting it (add action)")
+	branch := flag.String("branch", "", "Git branch to record with -repo-root (add action)")
+	commit := flag.String("commit", "", "Git commit to record with -repo-root (add action)")
+	remote := flag.String("remote", "", "Git remote URL to record with -repo-root (add action)")
+	repo := flag.String("repo", "", "Only get entries from this git repository: a directory inside it, its root, or its remote URL")
+	timeout := flag.Duration("timeout", 0, "Abort database operations after this duration, e.g. 2s (0 for no timeout)")
 	flag.Parse()
 
 	if *version {
@@ -44,7 +93,33 @@ func main() {
 		*format = string(histree.FormatVerbose)
 	}
 
-	db, err := histree.OpenDB(*dbPath)
+	// The template format is registered from -template
+	if histree.OutputFormat(*format) == formatTemplate {
+		if *entryTemplate == "" {
+			fmt.Fprintf(os.Stderr, "Error: -template parameter is required for -format template\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		formatter, err := histree.NewTemplateFormatter(*entryTemplate)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -template: %v\n", err)
+			os.Exit(1)
+		}
+		histree.RegisterFormat(formatTemplate, func() histree.Formatter { return formatter })
+	}
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	// Actions that only read never create the database, and only migrate
+	// it when asked to
+	readOnly := *action == "get" || *action == "search" || *action == "suggest"
+
+	db, err := openDB(ctx, *dbPath, readOnly, *immutable, *migrate, *timeout)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to initialize database: %v\n", err)
 		os.Exit(1)
@@ -63,64 +138,376 @@ func main() {
 			flag.Usage()
 			os.Exit(1)
 		}
-		if err := handleAdd(db, *currentDir, *hostname, *processID, *exitCode); err != nil {
+		startedAt, err := parseStartFlag(*startTime)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -start: %v\n", err)
+			os.Exit(1)
+		}
+		entry := histree.HistoryEntry{
+			Directory: *currentDir,
+			ExitCode:  *exitCode,
+			Hostname:  *hostname,
+			ProcessID: *processID,
+			SessionID: *sessionID,
+			StartedAt: startedAt,
+			Duration:  *duration,
+		}
+		if *repoRoot != "" {
+			entry.Repository = &histree.Repository{
+				Root:   *repoRoot,
+				Branch: *branch,
+				Commit: *commit,
+				Remote: *remote,
+			}
+		}
+		if err := handleAdd(ctx, db, entry, *detectGit); err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to add entry: %v\n", err)
 			os.Exit(1)
 		}
 
 	case "get":
-		if err := handleGet(db, *limit, *currentDir, histree.OutputFormat(*format)); err != nil {
+		now := time.Now()
+		sinceTime, err := parseTimeFlag(*since, now)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -since: %v\n", err)
+			os.Exit(1)
+		}
+		untilTime, err := parseTimeFlag(*until, now)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -until: %v\n", err)
+			os.Exit(1)
+		}
+		codes, err := parseExitCodes(*exitCodes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -exit-codes: %v\n", err)
+			os.Exit(1)
+		}
+		resultOrder, err := parseOrder(*order)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -order: %v\n", err)
+			os.Exit(1)
+		}
+		sortKey, err := parseSortKey(*sortBy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -sort: %v\n", err)
+			os.Exit(1)
+		}
+		dirMode, global, err := parseScope(*scope)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -scope: %v\n", err)
+			os.Exit(1)
+		}
+		repoID, err := parseRepoFlag(*repo)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -repo: %v\n", err)
+			os.Exit(1)
+		}
+
+		query := histree.Query{
+			Directory:   *currentDir,
+			Hostname:    *host,
+			ProcessID:   *processID,
+			SessionID:   *sessionID,
+			Repository:  repoID,
+			ExitCodes:   codes,
+			FailedOnly:  *failed,
+			Since:       sinceTime,
+			Until:       untilTime,
+			Contains:    *contains,
+			Regexp:      *regex,
+			Glob:        *glob,
+			MinDuration: *minDuration,
+			MaxDuration: *maxDuration,
+			Limit:       *limit,
+			Offset:      *offset,
+			Order:       resultOrder,
+			SortBy:      sortKey,
+			Unique:      *unique,
+			DirMode:     dirMode,
+			RootMarkers: parseList(*rootMarkers),
+		}
+		if *exactDir {
+			query.DirMode = histree.DirExact
+		}
+		switch {
+		case global:
+			query.Directory = ""
+		case query.DirMode == histree.DirProject && query.Directory == "":
+			// The project is found from the working directory by default
+			if query.Directory, err = os.Getwd(); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to get current directory: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		if err := handleGet(ctx, db, query, histree.OutputFormat(*format)); err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to get entries: %v\n", err)
 			os.Exit(1)
 		}
 		
+	case "search":
+		if *searchText == "" {
+			fmt.Fprintf(os.Stderr, "Error: -q parameter is required for search action\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if err := handleSearch(ctx, db, *searchText, *limit, *currentDir, histree.OutputFormat(*format)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to search entries: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "suggest":
+		// The previous commands are given as arguments, oldest first;
+		// without them, the last commands of -hostname and -pid are used
+		req := histree.SuggestRequest{
+			Directory: *currentDir,
+			Previous:  flag.Args(),
+			Hostname:  *hostname,
+			ProcessID: *processID,
+			Prefix:    *prefix,
+			Limit:     *limit,
+		}
+		if err := handleSuggest(ctx, db, req); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to suggest commands: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "import":
+		if *from == "" {
+			fmt.Fprintf(os.Stderr, "Error: -from parameter is required for import action\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if err := handleImport(ctx, db, importer.Format(*from), *file, *hostname); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to import history: %v\n", err)
+			os.Exit(1)
+		}
+
 	case "update-path":
 		if *oldPath == "" || *newPath == "" {
 			fmt.Fprintf(os.Stderr, "Error: both -old-path and -new-path parameters are required for update-path action\n")
 			flag.Usage()
 			os.Exit(1)
 		}
-		if err := handleUpdatePath(db, *oldPath, *newPath); err != nil {
+		if err := handleUpdatePath(ctx, db, *oldPath, *newPath, *dryRun); err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to update paths: %v\n", err)
 			os.Exit(1)
 		}
 
+	case "undo-path":
+		if flag.NArg() != 1 {
+			fmt.Fprintf(os.Stderr, "Error: undo-path action requires the rewrite ID printed by update-path\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		id, err := strconv.ParseInt(flag.Arg(0), 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid rewrite ID: %s\n", flag.Arg(0))
+			os.Exit(1)
+		}
+		if err := handleUndoPath(ctx, db, id); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to undo path update: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "reconcile":
+		opts := histree.ReconcileOptions{
+			Roots:    filepath.SplitList(*roots),
+			Hostname: *host,
+		}
+		if err := handleReconcile(ctx, db, opts, *dryRun, *yes); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to reconcile directories: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "alias-add":
+		if *oldPath == "" || *newPath == "" {
+			fmt.Fprintf(os.Stderr, "Error: both -old-path and -new-path parameters are required for alias-add action\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if err := handleAliasAdd(ctx, db, *oldPath, *newPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to add alias: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "alias-list":
+		if err := handleAliasList(ctx, db, histree.OutputFormat(*format)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list aliases: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "alias-remove":
+		if *oldPath == "" {
+			fmt.Fprintf(os.Stderr, "Error: -old-path parameter is required for alias-remove action\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		alias, err := absPath(*oldPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to remove alias: %v\n", err)
+			os.Exit(1)
+		}
+		if err := db.RemoveAlias(ctx, alias); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to remove alias: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "session-start":
+		session := histree.Session{
+			Shell:     *shell,
+			TTY:       *tty,
+			User:      *userName,
+			Hostname:  *hostname,
+			ProcessID: *processID,
+		}
+		if err := handleSessionStart(ctx, db, session); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start session: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "session-end":
+		if *sessionID == "" {
+			fmt.Fprintf(os.Stderr, "Error: -session parameter is required for session-end action\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if err := db.EndSession(ctx, *sessionID); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to end session: %v\n", err)
+			os.Exit(1)
+		}
+
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown action: %s\n", *action)
 		os.Exit(1)
 	}
 }
 
-func handleAdd(db *histree.DB, currentDir string, hostname string, processID int, exitCode int) error {
+func openDB(ctx context.Context, dbPath string, readOnly, immutable, migrate bool, timeout time.Duration) (*histree.DB, error) {
+	// SQLite waits for locks without watching ctx, so it must give up
+	// within the timeout by itself
+	var rwOpts []histree.Option
+	if timeout > 0 && timeout < histree.DefaultBusyTimeout {
+		rwOpts = append(rwOpts, histree.WithBusyTimeout(timeout))
+	}
+	if !readOnly {
+		return histree.OpenDBContext(ctx, dbPath, rwOpts...)
+	}
+
+	opts := append([]histree.Option{histree.WithReadOnly()}, rwOpts...)
+	if immutable {
+		opts = append(opts, histree.WithImmutable())
+	}
+
+	db, err := histree.OpenDBContext(ctx, dbPath, opts...)
+	if !errors.Is(err, histree.ErrSchemaOutdated) || immutable {
+		return db, err
+	}
+	if !migrate {
+		return nil, fmt.Errorf("%w; run with -migrate to upgrade it", err)
+	}
+
+	// Migrate with write access, then read as usual
+	rw, err := histree.OpenDBContext(ctx, dbPath, rwOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+	rw.Close()
+	return histree.OpenDBContext(ctx, dbPath, opts...)
+}
+
+// handleAdd records the command read from stdin, completing entry with the
+// current directory (if unset), time and, if detectGit is set and none was
+// given, the git repository
+func handleAdd(ctx context.Context, db *histree.DB, entry histree.HistoryEntry, detectGit bool) error {
 	var buf bytes.Buffer
 	if _, err := io.Copy(&buf, os.Stdin); err != nil {
 		return fmt.Errorf("failed to read command from stdin: %w", err)
 	}
-	cmd := strings.TrimRight(buf.String(), "\n")
+	entry.Command = strings.TrimRight(buf.String(), "\n")
 
-	dir := currentDir
-	if dir == "" {
-		var err error
-		dir, err = os.Getwd()
+	if entry.Directory == "" {
+		dir, err := os.Getwd()
 		if err != nil {
 			return fmt.Errorf("failed to get current directory: %w", err)
 		}
+		entry.Directory = dir
 	}
 
-	entry := histree.HistoryEntry{
-		Command:   cmd,
-		Directory: dir,
-		Timestamp: time.Now().UTC(),
-		ExitCode:  exitCode,
-		Hostname:  hostname,
-		ProcessID: processID,
+	if entry.Repository == nil && detectGit {
+		// A broken repository must not stop the command from being recorded
+		if repo, err := histree.DetectRepository(entry.Directory); err == nil {
+			entry.Repository = repo
+		}
 	}
 
-	return db.AddEntry(&entry)
+	entry.Timestamp = time.Now().UTC()
+
+	return db.AddEntryContext(ctx, &entry)
 }
 
-func handleGet(db *histree.DB, limit int, currentDir string, format histree.OutputFormat) error {
-	entries, err := db.GetEntries(limit, currentDir)
+// handleSessionStart records a new session, filling unset fields from the
+// environment, and prints its ID
+func handleSessionStart(ctx context.Context, db *histree.DB, session histree.Session) error {
+	if session.Shell == "" && os.Getenv("SHELL") != "" {
+		session.Shell = filepath.Base(os.Getenv("SHELL"))
+	}
+	if session.User == "" {
+		session.User = os.Getenv("USER")
+	}
+	if session.Hostname == "" {
+		if name, err := os.Hostname(); err == nil {
+			session.Hostname = name
+		}
+	}
+	if session.ProcessID == 0 {
+		session.ProcessID = os.Getppid()
+	}
+
+	if err := db.StartSession(ctx, &session); err != nil {
+		return err
+	}
+
+	fmt.Println(session.ID)
+	return nil
+}
+
+func handleGet(ctx context.Context, db *histree.DB, query histree.Query, format histree.OutputFormat) error {
+	// JSON output of unique commands carries their usage statistics
+	if format == histree.FormatJSON && (query.Unique || query.SortBy == histree.SortFrecency) {
+		entries, err := db.RankedEntries(ctx, query)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(os.Stdout)
+		enc := json.NewEncoder(w)
+		for _, entry := range entries {
+			if err := enc.Encode(entry); err != nil {
+				return fmt.Errorf("failed to encode JSON: %w", err)
+			}
+		}
+		return w.Flush()
+	}
+
+	ew, err := histree.NewEntryWriter(os.Stdout, format)
+	if err != nil {
+		return err
+	}
+
+	// Stream rows straight to the output instead of collecting them first
+	if err := db.Iterate(ctx, query, ew.Write); err != nil {
+		return err
+	}
+
+	return ew.Flush()
+}
+
+func handleSearch(ctx context.Context, db *histree.DB, text string, limit int, currentDir string, format histree.OutputFormat) error {
+	entries, err := db.SearchContext(ctx, histree.SearchQuery{
+		Text:      text,
+		Directory: currentDir,
+		Limit:     limit,
+	})
 	if err != nil {
 		return err
 	}
@@ -128,34 +515,204 @@ func handleGet(db *histree.DB, limit int, currentDir string, format histree.Outp
 	return histree.WriteEntries(entries, os.Stdout, format)
 }
 
-func handleUpdatePath(db *histree.DB, oldPath, newPath string) error {
-	// Convert to absolute paths if they aren't already
-	if !filepath.IsAbs(oldPath) {
-		absOldPath, err := filepath.Abs(oldPath)
+func handleSuggest(ctx context.Context, db *histree.DB, req histree.SuggestRequest) error {
+	suggestions, err := db.Suggest(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(w)
+	for _, suggestion := range suggestions {
+		if err := enc.Encode(suggestion); err != nil {
+			return fmt.Errorf("failed to encode JSON: %w", err)
+		}
+	}
+	return w.Flush()
+}
+
+// handleImport adds the commands of a history file that are not yet
+// recorded, attributing them to hostname or this machine
+func handleImport(ctx context.Context, db *histree.DB, format importer.Format, path, hostname string) error {
+	if path == "" {
+		var err error
+		if path, err = importer.DefaultPath(format); err != nil {
+			return err
+		}
+	}
+	if hostname == "" {
+		if name, err := os.Hostname(); err == nil {
+			hostname = name
+		}
+	}
+
+	entries, err := importer.Read(ctx, format, path)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		if entries[i].Hostname == "" {
+			entries[i].Hostname = hostname
+		}
+	}
+
+	added, err := db.AddEntries(ctx, entries, histree.AddEntriesOptions{SkipDuplicates: true})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d of %d entries from %s\n", added, len(entries), path)
+	return nil
+}
+
+func handleUpdatePath(ctx context.Context, db *histree.DB, oldPath, newPath string, dryRun bool) error {
+	oldPath, err := absPath(oldPath)
+	if err != nil {
+		return fmt.Errorf("failed to convert old path to absolute path: %w", err)
+	}
+	newPath, err = absPath(newPath)
+	if err != nil {
+		return fmt.Errorf("failed to convert new path to absolute path: %w", err)
+	}
+
+	// Update the paths in the database
+	report, err := db.RewritePaths(ctx, oldPath, newPath, histree.PathRewriteOptions{DryRun: dryRun})
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		for _, change := range report.Changes {
+			fmt.Printf("%s -> %s (%d entries)\n", change.OldDirectory, change.NewDirectory, change.Entries)
+		}
+		fmt.Printf("Would update %d entries: %s -> %s\n", report.Entries(), oldPath, newPath)
+		return nil
+	}
+
+	fmt.Printf("Updated %d entries: %s -> %s\n", report.Entries(), oldPath, newPath)
+	if report.ID != 0 {
+		fmt.Printf("Undo with: -action undo-path %d\n", report.ID)
+	}
+	return nil
+}
+
+// handleUndoPath reverses the path rewrite with the given journal ID
+func handleUndoPath(ctx context.Context, db *histree.DB, id int64) error {
+	report, err := db.UndoPathRewrite(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %d entries: %s -> %s\n", report.Entries(), report.OldPath, report.NewPath)
+	return nil
+}
+
+// handleReconcile proposes new locations for directories that no longer
+// exist and applies each one the user confirms
+func handleReconcile(ctx context.Context, db *histree.DB, opts histree.ReconcileOptions, dryRun, yes bool) error {
+	if len(opts.Roots) == 0 {
+		home, err := os.UserHomeDir()
 		if err != nil {
-			return fmt.Errorf("failed to convert old path to absolute path: %w", err)
+			return fmt.Errorf("failed to find home directory: %w", err)
 		}
-		oldPath = absOldPath
+		opts.Roots = []string{home}
+	}
+	if opts.Hostname == "" {
+		// Directories recorded on other machines are never found here
+		if name, err := os.Hostname(); err == nil {
+			opts.Hostname = name
+		}
+	}
+
+	moves, err := db.Reconcile(ctx, opts)
+	if err != nil {
+		return err
 	}
-	
-	if !filepath.IsAbs(newPath) {
-		absNewPath, err := filepath.Abs(newPath)
+	if len(moves) == 0 {
+		fmt.Println("No moved directories found")
+		return nil
+	}
+
+	answers := bufio.NewScanner(os.Stdin)
+	for _, move := range moves {
+		if move.NewPath == "" {
+			fmt.Printf("%s: %d entries, several candidates: %s\n", move.OldPath, move.Entries, strings.Join(move.Candidates, ", "))
+			continue
+		}
+		fmt.Printf("%s -> %s (%d entries, matched by %s)\n", move.OldPath, move.NewPath, move.Entries, move.Reason)
+		if dryRun {
+			continue
+		}
+
+		if !yes {
+			fmt.Print("Apply? [y/N] ")
+			if !answers.Scan() {
+				fmt.Println()
+				return answers.Err()
+			}
+			if answer := strings.ToLower(strings.TrimSpace(answers.Text())); answer != "y" && answer != "yes" {
+				continue
+			}
+		}
+
+		report, err := db.RewritePaths(ctx, move.OldPath, move.NewPath, histree.PathRewriteOptions{})
 		if err != nil {
-			return fmt.Errorf("failed to convert new path to absolute path: %w", err)
+			return err
+		}
+		fmt.Printf("Updated %d entries: %s -> %s\n", report.Entries(), move.OldPath, move.NewPath)
+		if report.ID != 0 {
+			fmt.Printf("Undo with: -action undo-path %d\n", report.ID)
 		}
-		newPath = absNewPath
 	}
-	
-	// Clean the paths to ensure consistent format
-	oldPath = filepath.Clean(oldPath)
-	newPath = filepath.Clean(newPath)
-	
-	// Update the paths in the database
-	count, err := db.UpdatePaths(oldPath, newPath)
+	return nil
+}
+
+// handleAliasAdd makes alias resolve to canonical in queries
+func handleAliasAdd(ctx context.Context, db *histree.DB, alias, canonical string) error {
+	alias, err := absPath(alias)
+	if err != nil {
+		return err
+	}
+	canonical, err = absPath(canonical)
+	if err != nil {
+		return err
+	}
+
+	if err := db.AddAlias(ctx, alias, canonical); err != nil {
+		return err
+	}
+
+	fmt.Printf("Added alias: %s -> %s\n", alias, canonical)
+	return nil
+}
+
+// handleAliasList prints every directory alias, as JSON lines for the json format
+func handleAliasList(ctx context.Context, db *histree.DB, format histree.OutputFormat) error {
+	aliases, err := db.Aliases(ctx)
 	if err != nil {
 		return err
 	}
-	
-	fmt.Printf("Updated %d entries: %s -> %s\n", count, oldPath, newPath)
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, alias := range aliases {
+		if format == histree.FormatJSON {
+			if err := enc.Encode(alias); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Printf("%s -> %s\n", alias.Alias, alias.Canonical)
+	}
 	return nil
 }
+
+// absPath converts path to a clean absolute path
+func absPath(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return "", err
+		}
+		path = abs
+	}
+	return filepath.Clean(path), nil
+}
@@ -2,12 +2,23 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/fuba/histree-core/pkg/histree"
+	"github.com/fuba/histree-core/pkg/importer"
 )
 
 func setupTestDB(t *testing.T) (*histree.DB, func()) {
@@ -41,7 +52,7 @@ func TestAddEntry(t *testing.T) {
 		t.Fatalf("Failed to add entry: %v", err)
 	}
 
-	rows, err := db.Query("SELECT command, directory, timestamp, exit_code, hostname, process_id FROM history")
+	rows, err := db.Query("SELECT command, directory, timestamp, exit_code, hostname, process_id FROM history_entries")
 	if err != nil {
 		t.Fatalf("Failed to query entries: %v", err)
 	}
@@ -265,7 +276,7 @@ func TestUpdatePaths(t *testing.T) {
 	}
 
 	// Verify the updates
-	rows, err := db.Query("SELECT directory FROM history ORDER BY id")
+	rows, err := db.Query("SELECT directory FROM history_entries ORDER BY id")
 	if err != nil {
 		t.Fatalf("Failed to query entries: %v", err)
 	}
@@ -297,3 +308,2547 @@ func TestUpdatePaths(t *testing.T) {
 		}
 	}
 }
+
+// TestMigrateLegacySchema tests that OpenDB converts a v0.1 database with a
+// session_label column and keeps a backup of the original file
+func TestMigrateLegacySchema(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "legacy.db")
+
+	legacy, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to create legacy database: %v", err)
+	}
+	_, err = legacy.Exec(`
+		CREATE TABLE history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			command TEXT NOT NULL,
+			directory TEXT NOT NULL,
+			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+			exit_code INTEGER NOT NULL,
+			session_label TEXT NOT NULL
+		);
+		INSERT INTO history (command, directory, exit_code, session_label)
+		VALUES ('make', '/home/user', 0, 'laptop@4242'), ('ls', '/tmp', 1, 'broken');
+	`)
+	legacy.Close()
+	if err != nil {
+		t.Fatalf("Failed to populate legacy database: %v", err)
+	}
+
+	db, err := histree.OpenDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open legacy database: %v", err)
+	}
+	defer db.Close()
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatalf("Failed to read schema version: %v", err)
+	}
+	if version == 0 {
+		t.Errorf("Expected schema version to be recorded, got 0")
+	}
+
+	rows, err := db.Query("SELECT hostname, process_id FROM history ORDER BY id")
+	if err != nil {
+		t.Fatalf("Failed to query migrated entries: %v", err)
+	}
+	defer rows.Close()
+
+	type session struct {
+		hostname  string
+		processID int
+	}
+	var got []session
+	for rows.Next() {
+		var s session
+		if err := rows.Scan(&s.hostname, &s.processID); err != nil {
+			t.Fatalf("Failed to scan row: %v", err)
+		}
+		got = append(got, s)
+	}
+	want := []session{{"laptop", 4242}, {"unknown", 0}}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d entries, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Entry %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+
+	backups, err := filepath.Glob(dbPath + ".bak.*")
+	if err != nil {
+		t.Fatalf("Failed to list backups: %v", err)
+	}
+	if len(backups) != 1 {
+		t.Errorf("Expected 1 backup file, got %d", len(backups))
+	}
+
+	// Reopening an up-to-date database must not create another backup
+	db2, err := histree.OpenDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	db2.Close()
+	backups, _ = filepath.Glob(dbPath + ".bak.*")
+	if len(backups) != 1 {
+		t.Errorf("Expected reopening to keep 1 backup file, got %d", len(backups))
+	}
+}
+
+// TestMigrateConcurrently tests that shells opening an outdated database at
+// the same time migrate it once and take a single backup
+func TestMigrateConcurrently(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "legacy.db")
+
+	legacy, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to create legacy database: %v", err)
+	}
+	_, err = legacy.Exec(`
+		CREATE TABLE history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			command TEXT NOT NULL,
+			directory TEXT NOT NULL,
+			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+			exit_code INTEGER NOT NULL,
+			session_label TEXT NOT NULL
+		);
+		INSERT INTO history (command, directory, exit_code, session_label)
+		VALUES ('make', '/home/user', 0, 'laptop@4242');
+	`)
+	legacy.Close()
+	if err != nil {
+		t.Fatalf("Failed to populate legacy database: %v", err)
+	}
+
+	const shells = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, shells)
+	for i := 0; i < shells; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db, err := histree.OpenDB(dbPath)
+			if err != nil {
+				errs <- err
+				return
+			}
+			db.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Failed to open database: %v", err)
+	}
+
+	backups, err := filepath.Glob(dbPath + ".bak.*")
+	if err != nil {
+		t.Fatalf("Failed to list backups: %v", err)
+	}
+	if len(backups) != 1 {
+		t.Errorf("Expected 1 backup file, got %d", len(backups))
+	}
+}
+
+// TestSearch tests full-text search over commands
+func TestSearch(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	commands := []struct {
+		command   string
+		directory string
+	}{
+		{"docker run --rm -it alpine:3.19 sh", "/home/user/app"},
+		{"docker ps", "/home/user/app"},
+		{"git status", "/home/user/app"},
+		{"docker run nginx", "/srv"},
+		{"echo 100%_done", "/tmp"},
+	}
+	for i, c := range commands {
+		entry := &histree.HistoryEntry{
+			Command:   c.command,
+			Directory: c.directory,
+			Timestamp: base.Add(time.Duration(i) * time.Minute),
+			Hostname:  "test-host",
+			ProcessID: 12345,
+		}
+		if err := db.AddEntry(entry); err != nil {
+			t.Fatalf("Failed to add entry: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query histree.SearchQuery
+		want  []string
+	}{
+		{
+			name:  "all words must match",
+			query: histree.SearchQuery{Text: "docker run"},
+			want:  []string{"docker run nginx", "docker run --rm -it alpine:3.19 sh"},
+		},
+		{
+			name:  "punctuation is literal",
+			query: histree.SearchQuery{Text: "alpine:3.19"},
+			want:  []string{"docker run --rm -it alpine:3.19 sh"},
+		},
+		{
+			name:  "directory filter",
+			query: histree.SearchQuery{Text: "docker", Directory: "/srv"},
+			want:  []string{"docker run nginx"},
+		},
+		{
+			name:  "limit",
+			query: histree.SearchQuery{Text: "run", Limit: 1},
+			want:  []string{"docker run nginx"},
+		},
+		{
+			name:  "no match",
+			query: histree.SearchQuery{Text: "kubectl"},
+			want:  []string{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := db.Search(tc.query)
+			if err != nil {
+				t.Fatalf("Failed to search: %v", err)
+			}
+			commands := make([]string, 0, len(got))
+			for _, entry := range got {
+				commands = append(commands, entry.Command)
+			}
+			if len(commands) != len(tc.want) {
+				t.Fatalf("Expected %q, got %q", tc.want, commands)
+			}
+			// Ranking differs between the FTS5 index and the fallback scan,
+			// so only compare the set of results
+			seen := make(map[string]bool)
+			for _, c := range commands {
+				seen[c] = true
+			}
+			for _, w := range tc.want {
+				if !seen[w] {
+					t.Errorf("Expected %q in results, got %q", w, commands)
+				}
+			}
+		})
+	}
+}
+
+// TestSearchIndexSync tests that entries added without updating the search
+// index, as builds without FTS5 do, are still found and indexed on open
+func TestSearchIndexSync(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "search.db")
+	db, err := histree.OpenDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer func() { db.Close() }()
+
+	var fts bool
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts); err != nil {
+		t.Fatalf("Failed to detect FTS5 support: %v", err)
+	}
+	if fts {
+		// Pretend the database was created by a build without FTS5
+		if _, err := db.Exec("DROP TABLE history_fts; UPDATE search_index SET last_history_id = 0"); err != nil {
+			t.Fatalf("Failed to drop search index: %v", err)
+		}
+		db.Close()
+		if db, err = histree.OpenDB(dbPath); err != nil {
+			t.Fatalf("Failed to reopen database: %v", err)
+		}
+	}
+
+	if err := db.AddEntry(&histree.HistoryEntry{Command: "docker ps", Directory: "/srv", Hostname: "test-host", ProcessID: 1}); err != nil {
+		t.Fatalf("Failed to add entry: %v", err)
+	}
+	// Bypass the index like a build without FTS5
+	_, err = db.Exec("INSERT INTO history (command, timestamp, exit_code, hostname, process_id) VALUES ('docker build .', ?, 0, 'test-host', 1)", time.Now().UTC())
+	if err != nil {
+		t.Fatalf("Failed to insert entry: %v", err)
+	}
+
+	search := func() {
+		t.Helper()
+		got, err := db.Search(histree.SearchQuery{Text: "docker"})
+		if err != nil {
+			t.Fatalf("Failed to search: %v", err)
+		}
+		if len(got) != 2 {
+			t.Errorf("Expected 2 results, got %d", len(got))
+		}
+	}
+	search()
+
+	db.Close()
+	if db, err = histree.OpenDB(dbPath); err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	search()
+
+	if fts {
+		var indexed int
+		if err := db.QueryRow("SELECT COUNT(*) FROM history_fts WHERE history_fts MATCH 'docker'").Scan(&indexed); err != nil {
+			t.Fatalf("Failed to query search index: %v", err)
+		}
+		if indexed != 2 {
+			t.Errorf("Expected 2 indexed entries, got %d", indexed)
+		}
+	}
+}
+
+// TestFind tests the composable query filters
+func TestFind(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	base := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	entries := []histree.HistoryEntry{
+		{Command: "make build", Directory: "/work/app", ExitCode: 0, Hostname: "laptop", ProcessID: 100},
+		{Command: "make test", Directory: "/work/app/pkg", ExitCode: 2, Hostname: "laptop", ProcessID: 100},
+		{Command: "go vet ./...", Directory: "/work/app", ExitCode: 1, Hostname: "server", ProcessID: 200},
+		{Command: "ls -la", Directory: "/work/application", ExitCode: 0, Hostname: "server", ProcessID: 200},
+		{Command: "git push", Directory: "/work/app", ExitCode: 0, Hostname: "laptop", ProcessID: 300},
+	}
+	for i := range entries {
+		entries[i].Timestamp = base.Add(time.Duration(i) * time.Hour)
+		if err := db.AddEntry(&entries[i]); err != nil {
+			t.Fatalf("Failed to add entry: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query histree.Query
+		want  []string
+	}{
+		{
+			name:  "subtree",
+			query: histree.Query{Directory: "/work/app"},
+			want:  []string{"make build", "make test", "go vet ./...", "git push"},
+		},
+		{
+			name:  "exact directory",
+			query: histree.Query{Directory: "/work/app", DirMode: histree.DirExact},
+			want:  []string{"make build", "go vet ./...", "git push"},
+		},
+		{
+			name:  "hostname and process",
+			query: histree.Query{Hostname: "laptop", ProcessID: 100},
+			want:  []string{"make build", "make test"},
+		},
+		{
+			name:  "failed only",
+			query: histree.Query{FailedOnly: true},
+			want:  []string{"make test", "go vet ./..."},
+		},
+		{
+			name:  "exit code set",
+			query: histree.Query{ExitCodes: []int{1, 2}},
+			want:  []string{"make test", "go vet ./..."},
+		},
+		{
+			name: "time range",
+			query: histree.Query{
+				Since: base.Add(time.Hour),
+				Until: base.Add(3 * time.Hour),
+			},
+			want: []string{"make test", "go vet ./..."},
+		},
+		{
+			name:  "since in another time zone",
+			query: histree.Query{Since: base.Add(4 * time.Hour).In(time.FixedZone("JST", 9*60*60))},
+			want:  []string{"git push"},
+		},
+		{
+			name:  "substring",
+			query: histree.Query{Contains: "make"},
+			want:  []string{"make build", "make test"},
+		},
+		{
+			name:  "regexp",
+			query: histree.Query{Regexp: `^(go|git) `},
+			want:  []string{"go vet ./...", "git push"},
+		},
+		{
+			name:  "glob",
+			query: histree.Query{Glob: "make *"},
+			want:  []string{"make build", "make test"},
+		},
+		{
+			name:  "limit keeps most recent",
+			query: histree.Query{Limit: 2},
+			want:  []string{"ls -la", "git push"},
+		},
+		{
+			name:  "offset and newest first",
+			query: histree.Query{Limit: 2, Offset: 1, Order: histree.OrderNewestFirst},
+			want:  []string{"ls -la", "go vet ./..."},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := db.Find(context.Background(), tc.query)
+			if err != nil {
+				t.Fatalf("Failed to find entries: %v", err)
+			}
+			commands := make([]string, 0, len(got))
+			for _, entry := range got {
+				commands = append(commands, entry.Command)
+			}
+			if strings.Join(commands, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("Expected %q, got %q", tc.want, commands)
+			}
+		})
+	}
+
+	if _, err := db.Find(context.Background(), histree.Query{Regexp: "("}); err == nil {
+		t.Errorf("Expected an error for an invalid regular expression")
+	}
+}
+
+// TestIterate tests streaming entries through Iterate and EntryWriter
+func TestIterate(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	base := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < 50; i++ {
+		entry := &histree.HistoryEntry{
+			Command:   fmt.Sprintf("echo %d", i),
+			Directory: "/home/user",
+			Timestamp: base.Add(time.Duration(i) * time.Second),
+			Hostname:  "test-host",
+			ProcessID: 12345,
+		}
+		if err := db.AddEntry(entry); err != nil {
+			t.Fatalf("Failed to add entry: %v", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	ew, err := histree.NewEntryWriter(&buf, histree.FormatSimple)
+	if err != nil {
+		t.Fatalf("Failed to create entry writer: %v", err)
+	}
+	if err := db.Iterate(context.Background(), histree.Query{}, ew.Write); err != nil {
+		t.Fatalf("Failed to iterate entries: %v", err)
+	}
+	if err := ew.Flush(); err != nil {
+		t.Fatalf("Failed to flush entries: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 50 || lines[0] != "echo 0" || lines[49] != "echo 49" {
+		t.Errorf("Unexpected streamed output: %q", lines)
+	}
+
+	// Returning an error from the callback stops the iteration
+	errStop := errors.New("stop")
+	visited := 0
+	err = db.Iterate(context.Background(), histree.Query{}, func(histree.HistoryEntry) error {
+		visited++
+		if visited == 3 {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) {
+		t.Errorf("Expected callback error, got %v", err)
+	}
+	if visited != 3 {
+		t.Errorf("Expected iteration to stop after 3 entries, visited %d", visited)
+	}
+
+	if _, err := histree.NewEntryWriter(&buf, histree.OutputFormat("xml")); err == nil {
+		t.Errorf("Expected an error for an unknown output format")
+	}
+}
+
+// TestContextCancellation tests that database methods honour a done context
+func TestContextCancellation(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	entry := &histree.HistoryEntry{
+		Command:   "sleep 1",
+		Directory: "/home/user",
+		Timestamp: time.Now().UTC(),
+		Hostname:  "test-host",
+		ProcessID: 12345,
+	}
+	if err := db.AddEntryContext(ctx, entry); !errors.Is(err, context.Canceled) {
+		t.Errorf("AddEntryContext: expected context.Canceled, got %v", err)
+	}
+	if _, err := db.GetEntriesContext(ctx, 10, "/home/user"); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetEntriesContext: expected context.Canceled, got %v", err)
+	}
+	if _, err := db.UpdatePathsContext(ctx, "/home/user", "/home/other"); !errors.Is(err, context.Canceled) {
+		t.Errorf("UpdatePathsContext: expected context.Canceled, got %v", err)
+	}
+	if _, err := db.SearchContext(ctx, histree.SearchQuery{Text: "sleep"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("SearchContext: expected context.Canceled, got %v", err)
+	}
+
+	// Nothing may have been written by the cancelled calls
+	entries, err := db.GetEntries(10, "/home/user")
+	if err != nil {
+		t.Fatalf("Failed to get entries: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected no entries after cancelled add, got %d", len(entries))
+	}
+}
+
+// TestTimeoutWhileLocked tests that -timeout bounds how long a command waits
+// for a lock held by another connection
+func TestTimeoutWhileLocked(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "locked.db")
+	db, err := histree.OpenDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM history"); err != nil {
+		t.Fatalf("Failed to take the write lock: %v", err)
+	}
+
+	cmd := helperCommand("-db", dbPath, "-action", "add", "-dir", "/tmp", "-hostname", "test-host", "-pid", "1", "-timeout", "1s")
+	cmd.Stdin = strings.NewReader("ls\n")
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	elapsed := time.Since(start)
+	if err == nil {
+		t.Errorf("Expected add to fail while the database is locked, got %q", out)
+	}
+	if elapsed > 3*time.Second {
+		t.Errorf("add -timeout 1s took %v", elapsed)
+	}
+}
+
+// TestHelperProcess is not a real test. It runs main with the arguments
+// following "--" when invoked by runHelperProcess.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("HISTREE_HELPER_PROCESS") != "1" {
+		return
+	}
+
+	args := os.Args
+	for i, arg := range args {
+		if arg == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	os.Args = append([]string{"histree-core"}, args...)
+	main()
+	os.Exit(0)
+}
+
+// helperCommand returns a command running main as a separate process
+func helperCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestHelperProcess$", "--"}, args...)...)
+	cmd.Env = append(os.Environ(), "HISTREE_HELPER_PROCESS=1")
+	return cmd
+}
+
+// TestConcurrentWriters hammers one database from many goroutines and
+// processes and checks that no entry is lost to "database is locked"
+func TestConcurrentWriters(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "concurrent.db")
+
+	// Create the schema up front so writers only contend on inserts
+	db, err := histree.OpenDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	const (
+		goroutines   = 16
+		perGoroutine = 25
+		processes    = 16
+	)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines*perGoroutine+processes)
+
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			// Each goroutine uses its own connection pool, like a separate shell
+			gdb, err := histree.OpenDB(dbPath)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer gdb.Close()
+
+			for i := 0; i < perGoroutine; i++ {
+				err := gdb.AddEntry(&histree.HistoryEntry{
+					Command:   fmt.Sprintf("goroutine %d command %d", g, i),
+					Directory: "/home/user",
+					Timestamp: time.Now().UTC(),
+					Hostname:  "test-host",
+					ProcessID: 1000 + g,
+				})
+				if err != nil {
+					errs <- err
+				}
+			}
+		}(g)
+	}
+
+	for p := 0; p < processes; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			cmd := helperCommand("-db", dbPath, "-action", "add", "-dir", "/home/user",
+				"-hostname", "test-host", "-pid", fmt.Sprint(2000+p))
+			cmd.Stdin = strings.NewReader(fmt.Sprintf("process %d command\n", p))
+			if out, err := cmd.CombinedOutput(); err != nil {
+				errs <- fmt.Errorf("process %d: %v: %s", p, err, out)
+			}
+		}(p)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Concurrent write failed: %v", err)
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM history").Scan(&count); err != nil {
+		t.Fatalf("Failed to count entries: %v", err)
+	}
+	if want := goroutines*perGoroutine + processes; count != want {
+		t.Errorf("Expected %d entries, got %d", want, count)
+	}
+}
+
+// recordingLogger collects log messages for inspection
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Printf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+// TestOpenOptions tests configuring OpenDB with functional options
+func TestOpenOptions(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "options.db")
+	fixed := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	logger := &recordingLogger{}
+
+	db, err := histree.OpenDB(dbPath,
+		histree.WithJournalMode("DELETE"),
+		histree.WithSynchronous("FULL"),
+		histree.WithCacheSize(-4000),
+		histree.WithBusyTimeout(time.Second),
+		histree.WithClock(func() time.Time { return fixed }),
+		histree.WithLogger(logger),
+	)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	// Pin a single connection so the pragmas read below come from the pool
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get connection: %v", err)
+	}
+	pragmas := []struct {
+		name string
+		want string
+	}{
+		{"journal_mode", "delete"},
+		{"synchronous", "2"},
+		{"cache_size", "-4000"},
+		{"busy_timeout", "1000"},
+		{"temp_store", "2"},
+	}
+	for _, p := range pragmas {
+		var got string
+		if err := conn.QueryRowContext(context.Background(), "PRAGMA "+p.name).Scan(&got); err != nil {
+			t.Fatalf("Failed to read PRAGMA %s: %v", p.name, err)
+		}
+		if got != p.want {
+			t.Errorf("PRAGMA %s: expected %s, got %s", p.name, p.want, got)
+		}
+	}
+	conn.Close()
+
+	// Entries without a timestamp use the configured clock
+	entry := &histree.HistoryEntry{Command: "date", Directory: "/", Hostname: "test-host", ProcessID: 1}
+	if err := db.AddEntry(entry); err != nil {
+		t.Fatalf("Failed to add entry: %v", err)
+	}
+	entries, err := db.GetEntries(1, "/")
+	if err != nil {
+		t.Fatalf("Failed to get entries: %v", err)
+	}
+	if len(entries) != 1 || !entries[0].Timestamp.Equal(fixed) {
+		t.Errorf("Expected entry stamped %v, got %+v", fixed, entries)
+	}
+	db.Close()
+
+	if len(logger.messages) == 0 || !strings.Contains(strings.Join(logger.messages, "\n"), "applied migration") {
+		t.Errorf("Expected migration log messages, got %q", logger.messages)
+	}
+
+	// A read-only connection can query but not write
+	ro, err := histree.OpenDB(dbPath, histree.WithReadOnly())
+	if err != nil {
+		t.Fatalf("Failed to open read-only database: %v", err)
+	}
+	defer ro.Close()
+	if _, err := ro.GetEntries(10, "/"); err != nil {
+		t.Errorf("Failed to read from read-only database: %v", err)
+	}
+	if err := ro.AddEntry(entry); err == nil {
+		t.Errorf("Expected write to read-only database to fail")
+	}
+
+	// Read-only mode never creates a database
+	missing := filepath.Join(t.TempDir(), "missing.db")
+	if db, err := histree.OpenDB(missing, histree.WithReadOnly()); err == nil {
+		db.Close()
+		t.Errorf("Expected opening a missing database read-only to fail")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("Read-only open created %s", missing)
+	}
+}
+
+// TestReadOnlySchemaChecks tests that read-only opens report schema
+// problems instead of creating or migrating the schema
+func TestReadOnlySchemaChecks(t *testing.T) {
+	dir := t.TempDir()
+
+	// An empty file has no schema and must stay empty
+	emptyPath := filepath.Join(dir, "empty.db")
+	if err := os.WriteFile(emptyPath, nil, 0o644); err != nil {
+		t.Fatalf("Failed to create empty database: %v", err)
+	}
+	if _, err := histree.OpenDB(emptyPath, histree.WithReadOnly()); !errors.Is(err, histree.ErrSchemaMissing) {
+		t.Errorf("Expected ErrSchemaMissing, got %v", err)
+	}
+	if info, err := os.Stat(emptyPath); err != nil || info.Size() != 0 {
+		t.Errorf("Read-only open modified the empty database: %v", err)
+	}
+
+	// Simulate a database last written by an older release
+	dbPath := filepath.Join(dir, "old.db")
+	db, err := histree.OpenDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := db.AddEntry(&histree.HistoryEntry{Command: "ls", Directory: "/tmp", Hostname: "test-host", ProcessID: 1}); err != nil {
+		t.Fatalf("Failed to add entry: %v", err)
+	}
+	if _, err := db.Exec("PRAGMA user_version = 1"); err != nil {
+		t.Fatalf("Failed to downgrade schema version: %v", err)
+	}
+	db.Close()
+
+	if _, err := histree.OpenDB(dbPath, histree.WithReadOnly()); !errors.Is(err, histree.ErrSchemaOutdated) {
+		t.Errorf("Expected ErrSchemaOutdated, got %v", err)
+	}
+
+	// Reading never migrates an outdated schema or backs it up unasked
+	out, err := helperCommand("-db", dbPath, "-action", "get", "-dir", "/tmp").CombinedOutput()
+	if err == nil || strings.Count(string(out), "migrate") != 1 || !strings.Contains(string(out), "-migrate") {
+		t.Errorf("Expected get to fail suggesting -migrate once, got %v: %s", err, out)
+	}
+	if backups, _ := filepath.Glob(dbPath + ".bak.*"); len(backups) != 0 {
+		t.Errorf("get backed up the database: %v", backups)
+	}
+	if _, err := histree.OpenDB(dbPath, histree.WithReadOnly()); !errors.Is(err, histree.ErrSchemaOutdated) {
+		t.Errorf("Expected get to leave the schema outdated, got %v", err)
+	}
+
+	// With -migrate, get upgrades the schema and then reads it
+	out, err = helperCommand("-db", dbPath, "-action", "get", "-dir", "/tmp", "-migrate").CombinedOutput()
+	if err != nil {
+		t.Fatalf("get -migrate failed: %v: %s", err, out)
+	}
+	if string(out) != "ls\n" {
+		t.Errorf("Expected get to print ls, got %q", out)
+	}
+
+	ro, err := histree.OpenDB(dbPath, histree.WithImmutable())
+	if err != nil {
+		t.Fatalf("Failed to open migrated database immutably: %v", err)
+	}
+	ro.Close()
+
+	// get never creates a missing database
+	missing := filepath.Join(dir, "missing.db")
+	if out, err := helperCommand("-db", missing, "-action", "get").CombinedOutput(); err == nil {
+		t.Errorf("Expected get on a missing database to fail, got %q", out)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("get created %s", missing)
+	}
+}
+
+// TestSessions tests recording and scoping history by shell session
+func TestSessions(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	first := &histree.Session{Shell: "zsh", TTY: "/dev/pts/1", User: "user", Hostname: "test-host", ProcessID: 4242}
+	if err := db.StartSession(ctx, first); err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+	if len(first.ID) != 36 || first.StartedAt.IsZero() {
+		t.Errorf("Expected generated ID and start time, got %+v", first)
+	}
+
+	// A later shell that happens to get the same PID is a different session
+	second := &histree.Session{Shell: "zsh", Hostname: "test-host", ProcessID: 4242}
+	if err := db.StartSession(ctx, second); err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+	if first.ID == second.ID {
+		t.Fatalf("Expected distinct session IDs, got %s twice", first.ID)
+	}
+
+	base := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	commands := []struct {
+		session *histree.Session
+		command string
+	}{
+		{first, "cd project"},
+		{second, "top"},
+		{first, "make"},
+		{first, "make install"},
+	}
+	for i, c := range commands {
+		err := db.AddEntry(&histree.HistoryEntry{
+			Command:   c.command,
+			Directory: "/home/user",
+			Timestamp: base.Add(time.Duration(i) * time.Minute),
+			Hostname:  "test-host",
+			ProcessID: 4242,
+			SessionID: c.session.ID,
+		})
+		if err != nil {
+			t.Fatalf("Failed to add entry: %v", err)
+		}
+	}
+
+	got, err := db.Find(ctx, histree.Query{SessionID: first.ID})
+	if err != nil {
+		t.Fatalf("Failed to find session entries: %v", err)
+	}
+	var replay []string
+	for _, entry := range got {
+		if entry.SessionID != first.ID {
+			t.Errorf("Entry %q has session %q, want %q", entry.Command, entry.SessionID, first.ID)
+		}
+		replay = append(replay, entry.Command)
+	}
+	if want := "cd project,make,make install"; strings.Join(replay, ",") != want {
+		t.Errorf("Expected session replay %q, got %q", want, replay)
+	}
+
+	if err := db.EndSession(ctx, first.ID); err != nil {
+		t.Fatalf("Failed to end session: %v", err)
+	}
+	session, err := db.GetSession(ctx, first.ID)
+	if err != nil {
+		t.Fatalf("Failed to get session: %v", err)
+	}
+	if session.EndedAt == nil || session.TTY != "/dev/pts/1" || session.Shell != "zsh" {
+		t.Errorf("Unexpected session after end: %+v", session)
+	}
+
+	if err := db.EndSession(ctx, "no-such-session"); !errors.Is(err, histree.ErrSessionNotFound) {
+		t.Errorf("Expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+// TestSessionCommands tests the session-start action and session scoping in the CLI
+func TestSessionCommands(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "sessions.db")
+
+	out, err := helperCommand("-db", dbPath, "-action", "session-start", "-shell", "bash", "-hostname", "test-host", "-pid", "77").Output()
+	if err != nil {
+		t.Fatalf("session-start failed: %v", err)
+	}
+	sessionID := strings.TrimSpace(string(out))
+	if len(sessionID) != 36 {
+		t.Fatalf("Expected a session ID, got %q", out)
+	}
+
+	for _, c := range []struct{ session, command string }{
+		{sessionID, "echo one"},
+		{"", "echo other"},
+		{sessionID, "echo two"},
+	} {
+		cmd := helperCommand("-db", dbPath, "-action", "add", "-dir", "/tmp", "-hostname", "test-host", "-pid", "77", "-session", c.session)
+		cmd.Stdin = strings.NewReader(c.command + "\n")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("add failed: %v: %s", err, out)
+		}
+	}
+
+	out, err = helperCommand("-db", dbPath, "-action", "get", "-session", sessionID).Output()
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if string(out) != "echo one\necho two\n" {
+		t.Errorf("Expected only the session's commands, got %q", out)
+	}
+
+	if out, err := helperCommand("-db", dbPath, "-action", "session-end", "-session", sessionID).CombinedOutput(); err != nil {
+		t.Errorf("session-end failed: %v: %s", err, out)
+	}
+}
+
+// TestDurations tests recording, filtering and sorting by command duration
+func TestDurations(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	base := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	started := base.Add(-90 * time.Second)
+	entries := []histree.HistoryEntry{
+		// Duration derived from the start time
+		{Command: "make build", StartedAt: &started, Timestamp: base},
+		// Start time derived from the duration
+		{Command: "go test ./...", Duration: 12 * time.Second, Timestamp: base.Add(time.Minute)},
+		{Command: "ls", Duration: 5 * time.Millisecond, Timestamp: base.Add(2 * time.Minute)},
+		// Unknown duration
+		{Command: "cd /tmp", Timestamp: base.Add(3 * time.Minute)},
+	}
+	for i := range entries {
+		entries[i].Directory = "/work"
+		entries[i].Hostname = "test-host"
+		entries[i].ProcessID = 1
+		if err := db.AddEntry(&entries[i]); err != nil {
+			t.Fatalf("Failed to add entry: %v", err)
+		}
+	}
+
+	all, err := db.Find(ctx, histree.Query{})
+	if err != nil {
+		t.Fatalf("Failed to find entries: %v", err)
+	}
+	if all[0].Duration != 90*time.Second || all[0].StartedAt == nil || !all[0].StartedAt.Equal(started) {
+		t.Errorf("Expected 90s duration from start time, got %+v", all[0])
+	}
+	if all[1].StartedAt == nil || !all[1].StartedAt.Equal(base.Add(48*time.Second)) {
+		t.Errorf("Expected start time derived from duration, got %+v", all[1])
+	}
+	if all[3].Duration != 0 || all[3].StartedAt != nil {
+		t.Errorf("Expected unknown duration, got %+v", all[3])
+	}
+
+	tests := []struct {
+		name  string
+		query histree.Query
+		want  string
+	}{
+		{"min duration", histree.Query{MinDuration: 10 * time.Second}, "make build,go test ./..."},
+		{"max duration", histree.Query{MaxDuration: time.Second}, "ls"},
+		{"slowest first", histree.Query{SortBy: histree.SortDuration, Order: histree.OrderDescending}, "make build,go test ./...,ls"},
+		{"two slowest ascending", histree.Query{SortBy: histree.SortDuration, Limit: 2}, "go test ./...,make build"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := db.Find(ctx, tc.query)
+			if err != nil {
+				t.Fatalf("Failed to find entries: %v", err)
+			}
+			var commands []string
+			for _, entry := range got {
+				commands = append(commands, entry.Command)
+			}
+			if strings.Join(commands, ",") != tc.want {
+				t.Errorf("Expected %s, got %q", tc.want, commands)
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := histree.WriteEntries(all[:1], &buf, histree.FormatVerbose); err != nil {
+		t.Fatalf("Failed to write entries: %v", err)
+	}
+	if !strings.Contains(buf.String(), "(1m30s) make build") {
+		t.Errorf("Expected duration in verbose output, got %q", buf.String())
+	}
+}
+
+func TestRewritePaths(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	dirs := []string{
+		"/home/user/a_b",
+		"/home/user/a_b/x/home/user/a_b",
+		"/home/user/aXb",
+		"/home/user/a%",
+		"/home/user/a%z",
+		"/home/user/A_B",
+		"/home/user/a*",
+		"/home/user/a_bc",
+	}
+	for _, dir := range dirs {
+		entry := histree.HistoryEntry{Command: "ls", Directory: dir, Hostname: "test-host", ProcessID: 1}
+		if err := db.AddEntry(&entry); err != nil {
+			t.Fatalf("Failed to add entry: %v", err)
+		}
+	}
+
+	directories := func() []string {
+		entries, err := db.Find(ctx, histree.Query{})
+		if err != nil {
+			t.Fatalf("Failed to find entries: %v", err)
+		}
+		var got []string
+		for _, entry := range entries {
+			got = append(got, entry.Directory)
+		}
+		return got
+	}
+
+	// Wildcards in the directory filter match literally
+	for dir, want := range map[string]int{"/home/user/a_b": 2, "/home/user/a%": 1, "/home/user/a*": 1} {
+		entries, err := db.Find(ctx, histree.Query{Directory: dir})
+		if err != nil {
+			t.Fatalf("Failed to find entries: %v", err)
+		}
+		if len(entries) != want {
+			t.Errorf("Find(%q) returned %d entries, want %d", dir, len(entries), want)
+		}
+	}
+
+	report, err := db.RewritePaths(ctx, "/home/user/a_b/", "/srv/new", histree.PathRewriteOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("Failed to dry-run rewrite: %v", err)
+	}
+	wantChanges := []histree.PathChange{
+		{OldDirectory: "/home/user/a_b", NewDirectory: "/srv/new", Entries: 1},
+		{OldDirectory: "/home/user/a_b/x/home/user/a_b", NewDirectory: "/srv/new/x/home/user/a_b", Entries: 1},
+	}
+	if fmt.Sprint(report.Changes) != fmt.Sprint(wantChanges) {
+		t.Errorf("Changes = %v, want %v", report.Changes, wantChanges)
+	}
+	if report.Entries() != 2 {
+		t.Errorf("Entries() = %d, want 2", report.Entries())
+	}
+	if got := directories(); fmt.Sprint(got) != fmt.Sprint(dirs) {
+		t.Errorf("Dry run modified directories: %v", got)
+	}
+
+	count, err := db.UpdatePaths("/home/user/a_b", "/srv/new")
+	if err != nil {
+		t.Fatalf("Failed to update paths: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Updated %d entries, want 2", count)
+	}
+
+	want := append([]string{"/srv/new", "/srv/new/x/home/user/a_b"}, dirs[2:]...)
+	if got := directories(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Directories = %v, want %v", got, want)
+	}
+
+	if _, err := db.UpdatePaths("", "/srv"); err == nil {
+		t.Error("Expected an error for an empty old path")
+	}
+}
+
+func TestRewritePathsIntoSubdirectory(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, dir := range []string{"/a", "/a/b", "/a/c"} {
+		entry := histree.HistoryEntry{Command: "ls", Directory: dir, Hostname: "test-host", ProcessID: 1}
+		if err := db.AddEntry(&entry); err != nil {
+			t.Fatalf("Failed to add entry: %v", err)
+		}
+	}
+
+	directories := func() []string {
+		entries, err := db.Find(ctx, histree.Query{})
+		if err != nil {
+			t.Fatalf("Failed to find entries: %v", err)
+		}
+		var got []string
+		for _, entry := range entries {
+			got = append(got, entry.Directory)
+		}
+		return got
+	}
+
+	report, err := db.RewritePaths(ctx, "/a", "/a/b", histree.PathRewriteOptions{})
+	if err != nil {
+		t.Fatalf("Failed to rewrite paths: %v", err)
+	}
+	wantChanges := []histree.PathChange{
+		{OldDirectory: "/a", NewDirectory: "/a/b", Entries: 1},
+		{OldDirectory: "/a/b", NewDirectory: "/a/b/b", Entries: 1},
+		{OldDirectory: "/a/c", NewDirectory: "/a/b/c", Entries: 1},
+	}
+	if fmt.Sprint(report.Changes) != fmt.Sprint(wantChanges) {
+		t.Errorf("Changes = %v, want %v", report.Changes, wantChanges)
+	}
+	want := []string{"/a/b", "/a/b/b", "/a/b/c"}
+	if got := directories(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Directories = %v, want %v", got, want)
+	}
+
+	entries, err := db.Find(ctx, histree.Query{Directory: "/a", DirMode: histree.DirExact})
+	if err != nil {
+		t.Fatalf("Failed to find entries: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Found %d entries in /a, want 0", len(entries))
+	}
+
+	if _, err := db.UndoPathRewrite(ctx, report.ID); err != nil {
+		t.Fatalf("Failed to undo path rewrite: %v", err)
+	}
+	want = []string{"/a", "/a/b", "/a/c"}
+	if got := directories(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Directories after undo = %v, want %v", got, want)
+	}
+}
+
+// TestUndoPathRewrite tests the path rewrite journal and the update-path and undo-path actions
+func TestRewriteRootPath(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, dir := range []string{"/", "/home/u", "/home/u/src"} {
+		entry := histree.HistoryEntry{
+			Command:    "ls",
+			Directory:  dir,
+			Hostname:   "test-host",
+			ProcessID:  1,
+			Repository: &histree.Repository{Root: "/home/u/src"},
+		}
+		if err := db.AddEntry(&entry); err != nil {
+			t.Fatalf("Failed to add entry: %v", err)
+		}
+	}
+
+	paths := func() string {
+		entries, err := db.Find(ctx, histree.Query{})
+		if err != nil {
+			t.Fatalf("Failed to find entries: %v", err)
+		}
+		var got []string
+		for _, entry := range entries {
+			got = append(got, entry.Directory+":"+entry.Repository.Root)
+		}
+		return strings.Join(got, " ")
+	}
+
+	report, err := db.RewritePaths(ctx, "/", "/mnt", histree.PathRewriteOptions{})
+	if err != nil {
+		t.Fatalf("Failed to rewrite paths: %v", err)
+	}
+	wantChanges := []histree.PathChange{
+		{OldDirectory: "/", NewDirectory: "/mnt", Entries: 1},
+		{OldDirectory: "/home/u", NewDirectory: "/mnt/home/u", Entries: 1},
+		{OldDirectory: "/home/u/src", NewDirectory: "/mnt/home/u/src", Entries: 1},
+	}
+	if fmt.Sprint(report.Changes) != fmt.Sprint(wantChanges) {
+		t.Errorf("Changes = %v, want %v", report.Changes, wantChanges)
+	}
+	if got, want := paths(), "/mnt:/mnt/home/u/src /mnt/home/u:/mnt/home/u/src /mnt/home/u/src:/mnt/home/u/src"; got != want {
+		t.Errorf("Paths = %s, want %s", got, want)
+	}
+
+	if _, err := db.UndoPathRewrite(ctx, report.ID); err != nil {
+		t.Fatalf("Failed to undo rewrite: %v", err)
+	}
+	if got, want := paths(), "/:/home/u/src /home/u:/home/u/src /home/u/src:/home/u/src"; got != want {
+		t.Errorf("Paths after undo = %s, want %s", got, want)
+	}
+
+	// Rewriting to the root keeps a single separator
+	if _, err := db.RewritePaths(ctx, "/home/u", "/", histree.PathRewriteOptions{}); err != nil {
+		t.Fatalf("Failed to rewrite paths: %v", err)
+	}
+	if got, want := paths(), "/:/src /:/src /src:/src"; got != want {
+		t.Errorf("Paths = %s, want %s", got, want)
+	}
+}
+
+func TestUndoPathRewrite(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "paths.db")
+
+	for _, dir := range []string{"/src/app", "/src/app/lib", "/src/apple", "/tmp"} {
+		cmd := helperCommand("-db", dbPath, "-action", "add", "-dir", dir, "-hostname", "test-host", "-pid", "1")
+		cmd.Stdin = strings.NewReader("ls\n")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("add failed: %v: %s", err, out)
+		}
+	}
+
+	directories := func() string {
+		out, err := helperCommand("-db", dbPath, "-action", "get", "-format", "json").Output()
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		var dirs []string
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			var entry histree.HistoryEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("Failed to parse %q: %v", line, err)
+			}
+			dirs = append(dirs, entry.Directory)
+		}
+		return strings.Join(dirs, " ")
+	}
+
+	out, err := helperCommand("-db", dbPath, "-action", "update-path", "-old-path", "/src/app", "-new-path", "/src/web", "-dry-run").Output()
+	if err != nil {
+		t.Fatalf("update-path -dry-run failed: %v", err)
+	}
+	want := "/src/app -> /src/web (1 entries)\n/src/app/lib -> /src/web/lib (1 entries)\nWould update 2 entries: /src/app -> /src/web\n"
+	if string(out) != want {
+		t.Errorf("Dry run printed %q, want %q", out, want)
+	}
+	if got := directories(); got != "/src/app /src/app/lib /src/apple /tmp" {
+		t.Errorf("Dry run changed directories: %s", got)
+	}
+
+	out, err = helperCommand("-db", dbPath, "-action", "update-path", "-old-path", "/src/app", "-new-path", "/src/web").Output()
+	if err != nil {
+		t.Fatalf("update-path failed: %v", err)
+	}
+	if !strings.Contains(string(out), "-action undo-path 1\n") {
+		t.Errorf("Expected the rewrite ID in %q", out)
+	}
+	if got := directories(); got != "/src/web /src/web/lib /src/apple /tmp" {
+		t.Errorf("Unexpected directories after update-path: %s", got)
+	}
+
+	// Entries recorded after the rewrite stay where they are
+	cmd := helperCommand("-db", dbPath, "-action", "add", "-dir", "/src/web", "-hostname", "test-host", "-pid", "1")
+	cmd.Stdin = strings.NewReader("make\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("add failed: %v: %s", err, out)
+	}
+
+	// Entries moved again after the rewrite are not restored
+	db, err := histree.OpenDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if _, err := db.UpdatePaths("/src/web/lib", "/opt/lib"); err != nil {
+		t.Fatalf("Failed to update paths: %v", err)
+	}
+	db.Close()
+
+	out, err = helperCommand("-db", dbPath, "-action", "undo-path", "1").Output()
+	if err != nil {
+		t.Fatalf("undo-path failed: %v", err)
+	}
+	if string(out) != "Restored 1 entries: /src/web -> /src/app\n" {
+		t.Errorf("Unexpected undo-path output %q", out)
+	}
+	if got := directories(); got != "/src/app /opt/lib /src/apple /tmp /src/web" {
+		t.Errorf("Unexpected directories after undo-path: %s", got)
+	}
+
+	db, err = histree.OpenDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	if _, err := db.UndoPathRewrite(ctx, 1); !errors.Is(err, histree.ErrPathRewriteUndone) {
+		t.Errorf("Expected ErrPathRewriteUndone, got %v", err)
+	}
+	if _, err := db.UndoPathRewrite(ctx, 99); !errors.Is(err, histree.ErrPathRewriteNotFound) {
+		t.Errorf("Expected ErrPathRewriteNotFound, got %v", err)
+	}
+	report, err := db.UndoPathRewrite(ctx, 2)
+	if err != nil {
+		t.Fatalf("Failed to undo rewrite: %v", err)
+	}
+	if report.Entries() != 1 || report.Changes[0].NewDirectory != "/src/web/lib" {
+		t.Errorf("Unexpected undo report: %+v", report)
+	}
+
+	// A directory merged into an existing one is restored entry by entry
+	report, err = db.RewritePaths(ctx, "/src/apple", "/tmp", histree.PathRewriteOptions{})
+	if err != nil {
+		t.Fatalf("Failed to rewrite paths: %v", err)
+	}
+	if got := directories(); got != "/src/app /src/web/lib /tmp /tmp /src/web" {
+		t.Errorf("Unexpected directories after merging: %s", got)
+	}
+	if _, err := db.UndoPathRewrite(ctx, report.ID); err != nil {
+		t.Fatalf("Failed to undo rewrite: %v", err)
+	}
+	if got := directories(); got != "/src/app /src/web/lib /src/apple /tmp /src/web" {
+		t.Errorf("Unexpected directories after undoing the merge: %s", got)
+	}
+
+	// A rewrite whose entries have all moved again is left to undo later
+	report, err = db.RewritePaths(ctx, "/tmp", "/var/tmp", histree.PathRewriteOptions{})
+	if err != nil {
+		t.Fatalf("Failed to rewrite paths: %v", err)
+	}
+	if _, err := db.UpdatePaths("/var/tmp", "/srv"); err != nil {
+		t.Fatalf("Failed to update paths: %v", err)
+	}
+	if _, err := db.UndoPathRewrite(ctx, report.ID); !errors.Is(err, histree.ErrNothingToUndo) {
+		t.Errorf("Expected ErrNothingToUndo, got %v", err)
+	}
+	if _, err := db.UpdatePaths("/srv", "/var/tmp"); err != nil {
+		t.Fatalf("Failed to update paths: %v", err)
+	}
+	if _, err := db.UndoPathRewrite(ctx, report.ID); err != nil {
+		t.Fatalf("Failed to undo rewrite: %v", err)
+	}
+	if got := directories(); got != "/src/app /src/web/lib /src/apple /tmp /src/web" {
+		t.Errorf("Unexpected directories after undoing the rewrite: %s", got)
+	}
+}
+
+// TestAliases tests that queries resolve directory aliases
+func TestAliases(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, e := range []struct{ dir, command string }{
+		{"/home/x/proj", "make"},
+		{"/Users/x/proj/src", "go test"},
+		{"/mnt/x/proj", "ls"},
+		{"/Users/x/other", "vim"},
+		{"/old/proj", "git log"},
+	} {
+		entry := histree.HistoryEntry{Command: e.command, Directory: e.dir, Hostname: "test-host", ProcessID: 1}
+		if err := db.AddEntry(&entry); err != nil {
+			t.Fatalf("Failed to add entry: %v", err)
+		}
+	}
+
+	for _, a := range [][2]string{
+		{"/Users/x", "/home/x"},
+		{"/mnt/x/", "/home/x"},
+		{"/old/proj", "/home/x/proj"},
+	} {
+		if err := db.AddAlias(ctx, a[0], a[1]); err != nil {
+			t.Fatalf("Failed to add alias %s: %v", a[0], err)
+		}
+	}
+
+	if err := db.AddAlias(ctx, "/home/x", "/Users/x/y"); err == nil {
+		t.Error("Expected an error for a cyclic alias")
+	}
+
+	aliases, err := db.Aliases(ctx)
+	if err != nil {
+		t.Fatalf("Failed to list aliases: %v", err)
+	}
+	if len(aliases) != 3 || aliases[1].Alias != "/mnt/x" {
+		t.Errorf("Unexpected aliases: %+v", aliases)
+	}
+
+	commands := func(q histree.Query) string {
+		entries, err := db.Find(ctx, q)
+		if err != nil {
+			t.Fatalf("Failed to find entries: %v", err)
+		}
+		var got []string
+		for _, entry := range entries {
+			got = append(got, entry.Command)
+		}
+		return strings.Join(got, ",")
+	}
+
+	tests := []struct {
+		name  string
+		query histree.Query
+		want  string
+	}{
+		{"canonical subtree", histree.Query{Directory: "/home/x/proj"}, "make,go test,ls,git log"},
+		{"alias subtree", histree.Query{Directory: "/Users/x/proj"}, "make,go test,ls,git log"},
+		{"moved project", histree.Query{Directory: "/old/proj"}, "make,go test,ls,git log"},
+		{"exact", histree.Query{Directory: "/mnt/x/proj", DirMode: histree.DirExact}, "make,ls,git log"},
+		{"home", histree.Query{Directory: "/home/x"}, "make,go test,ls,vim,git log"},
+		{"alias inside subtree", histree.Query{Directory: "/home"}, "make,go test,ls,vim,git log"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := commands(tt.query); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if err := db.RemoveAlias(ctx, "/old/proj"); err != nil {
+		t.Fatalf("Failed to remove alias: %v", err)
+	}
+	if got := commands(histree.Query{Directory: "/old/proj"}); got != "git log" {
+		t.Errorf("got %q after removing the alias", got)
+	}
+	if err := db.RemoveAlias(ctx, "/old/proj"); !errors.Is(err, histree.ErrAliasNotFound) {
+		t.Errorf("Expected ErrAliasNotFound, got %v", err)
+	}
+}
+
+// TestReconcile tests detecting moved directories in a temporary tree
+func TestReconcile(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	root := t.TempDir()
+	mkdir := func(path string) string {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatalf("Failed to create %s: %v", path, err)
+		}
+		return path
+	}
+
+	renamed := mkdir("work/app")
+	mkdir("work/app/lib")
+	named := mkdir("old/tool")
+	ambiguous := mkdir("old/docs")
+	kept := mkdir("kept")
+	for _, dir := range []string{renamed, renamed + "/lib", named, ambiguous, kept, "/nonexistent/elsewhere"} {
+		entry := histree.HistoryEntry{Command: "ls", Directory: dir, Hostname: "test-host", ProcessID: 1}
+		if err := db.AddEntry(&entry); err != nil {
+			t.Fatalf("Failed to add entry: %v", err)
+		}
+	}
+
+	// The renamed directory is found by inode. The tool and docs were
+	// re-created elsewhere, so only their names match; the new directories
+	// are created first so they cannot reuse the old inodes.
+	mkdir("new/tool")
+	mkdir("a/docs")
+	mkdir("b/docs")
+	if err := os.Rename(renamed, filepath.Join(root, "work/renamed")); err != nil {
+		t.Fatalf("Failed to move %s: %v", renamed, err)
+	}
+	for _, dir := range []string{named, ambiguous} {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatalf("Failed to remove %s: %v", dir, err)
+		}
+	}
+
+	if _, err := db.Reconcile(ctx, histree.ReconcileOptions{}); err == nil {
+		t.Error("Expected an error without search roots")
+	}
+
+	moves, err := db.Reconcile(ctx, histree.ReconcileOptions{Roots: []string{root}, Hostname: "test-host"})
+	if err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+
+	got := map[string]histree.DirectoryMove{}
+	for _, m := range moves {
+		got[m.OldPath] = m
+	}
+	if len(got) != 3 {
+		t.Errorf("Expected 3 proposals, got %+v", moves)
+	}
+	if m := got[renamed]; m.NewPath != filepath.Join(root, "work/renamed") || m.Reason != histree.MatchInode || m.Entries != 2 {
+		t.Errorf("Unexpected move for renamed directory: %+v", m)
+	}
+	if m := got[named]; m.NewPath != filepath.Join(root, "new/tool") || m.Reason != histree.MatchBasename {
+		t.Errorf("Unexpected move for re-created directory: %+v", m)
+	}
+	if m := got[ambiguous]; m.NewPath != "" || len(m.Candidates) != 2 {
+		t.Errorf("Expected two candidates for ambiguous directory: %+v", m)
+	}
+
+	for _, m := range moves {
+		if m.NewPath == "" {
+			continue
+		}
+		if _, err := db.UpdatePaths(m.OldPath, m.NewPath); err != nil {
+			t.Fatalf("Failed to apply move: %v", err)
+		}
+	}
+
+	entries, err := db.Find(ctx, histree.Query{Directory: filepath.Join(root, "work/renamed")})
+	if err != nil {
+		t.Fatalf("Failed to find entries: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Expected the subtree to move with its parent, got %d entries", len(entries))
+	}
+
+	// Directories of other hosts are not checked
+	moves, err = db.Reconcile(ctx, histree.ReconcileOptions{Roots: []string{root}, Hostname: "other-host"})
+	if err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+	if len(moves) != 0 {
+		t.Errorf("Expected no proposals for another host, got %+v", moves)
+	}
+}
+
+// TestNormalizedDirectories tests the directories table behind entry paths
+func TestNormalizedDirectories(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, dir := range []string{"/p/a", "/p/a/b", "/q/a", "/p/a/b"} {
+		entry := histree.HistoryEntry{Command: "ls", Directory: dir, Hostname: "test-host", ProcessID: 1}
+		if err := db.AddEntry(&entry); err != nil {
+			t.Fatalf("Failed to add entry: %v", err)
+		}
+	}
+
+	type directory struct {
+		path   string
+		parent string
+		depth  int
+	}
+	directories := func() []directory {
+		rows, err := db.Query(`
+			SELECT d.path, COALESCE(p.path, ''), d.depth
+			FROM directories d LEFT JOIN directories p ON p.id = d.parent_id
+			ORDER BY d.path`)
+		if err != nil {
+			t.Fatalf("Failed to query directories: %v", err)
+		}
+		defer rows.Close()
+		var dirs []directory
+		for rows.Next() {
+			var d directory
+			if err := rows.Scan(&d.path, &d.parent, &d.depth); err != nil {
+				t.Fatalf("Failed to scan row: %v", err)
+			}
+			dirs = append(dirs, d)
+		}
+		return dirs
+	}
+
+	want := []directory{{"/", "", 0}, {"/p", "/", 1}, {"/p/a", "/p", 2}, {"/p/a/b", "/p/a", 3}, {"/q", "/", 1}, {"/q/a", "/q", 2}}
+	if got := directories(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Directories = %v, want %v", got, want)
+	}
+
+	var columns int
+	if err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('history') WHERE name = 'directory'").Scan(&columns); err != nil {
+		t.Fatalf("Failed to inspect history table: %v", err)
+	}
+	if columns != 0 {
+		t.Error("Expected history to refer to directories by ID only")
+	}
+
+	// Moving /p/a onto the existing /q/a merges the two directories
+	count, err := db.UpdatePaths("/p/a", "/q/a")
+	if err != nil {
+		t.Fatalf("Failed to update paths: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("Updated %d entries, want 3", count)
+	}
+
+	want = []directory{{"/", "", 0}, {"/p", "/", 1}, {"/q", "/", 1}, {"/q/a", "/q", 2}, {"/q/a/b", "/q/a", 3}}
+	if got := directories(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Directories after move = %v, want %v", got, want)
+	}
+
+	entries, err := db.Find(ctx, histree.Query{Directory: "/q/a"})
+	if err != nil {
+		t.Fatalf("Failed to find entries: %v", err)
+	}
+	var dirs []string
+	for _, entry := range entries {
+		dirs = append(dirs, entry.Directory)
+	}
+	if got := strings.Join(dirs, " "); got != "/q/a /q/a/b /q/a /q/a/b" {
+		t.Errorf("Entries are in %s", got)
+	}
+
+	// Moving to a new parent creates it
+	if _, err := db.UpdatePaths("/q/a/b", "/r/s/b"); err != nil {
+		t.Fatalf("Failed to update paths: %v", err)
+	}
+	entries, err = db.Find(ctx, histree.Query{Directory: "/r", DirMode: histree.DirSubtree})
+	if err != nil {
+		t.Fatalf("Failed to find entries: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Expected 2 entries under /r, got %d", len(entries))
+	}
+	var depth int
+	if err := db.QueryRow("SELECT depth FROM directories WHERE path = '/r/s/b'").Scan(&depth); err != nil || depth != 3 {
+		t.Errorf("Expected /r/s/b at depth 3, got %d (%v)", depth, err)
+	}
+}
+
+// TestRepository tests detecting, recording and scoping by git repository
+func TestRepository(t *testing.T) {
+	root := t.TempDir()
+	write := func(path, content string) {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create %s: %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+
+	const origin = "git@example.com:team/app.git"
+	config := "[core]\n\tbare = false\n[remote \"upstream\"]\n\turl = https://example.com/upstream.git\n[remote \"origin\"]\n\turl = " + origin + "\n"
+	write("main/.git/HEAD", "ref: refs/heads/feature/x\n")
+	write("main/.git/refs/heads/feature/x", "aaaa\n")
+	write("main/.git/config", config)
+	write("main/.git/packed-refs", "# pack-refs with: peeled\nbbbb refs/heads/other\n")
+	write("main/src/pkg/file.go", "package pkg\n")
+	write("main/.git/worktrees/wt/HEAD", "ref: refs/heads/other\n")
+	write("main/.git/worktrees/wt/commondir", "../..\n")
+	write("wt/.git", "gitdir: ../main/.git/worktrees/wt\n")
+	write("detached/.git/HEAD", "cccc\n")
+
+	tests := []struct {
+		dir  string
+		want histree.Repository
+	}{
+		{"main/src/pkg", histree.Repository{Root: filepath.Join(root, "main"), Branch: "feature/x", Commit: "aaaa", Remote: origin}},
+		{"wt", histree.Repository{Root: filepath.Join(root, "wt"), Branch: "other", Commit: "bbbb", Remote: origin}},
+		{"detached", histree.Repository{Root: filepath.Join(root, "detached"), Commit: "cccc"}},
+	}
+	for _, tt := range tests {
+		repo, err := histree.DetectRepository(filepath.Join(root, tt.dir))
+		if err != nil {
+			t.Fatalf("Failed to detect repository of %s: %v", tt.dir, err)
+		}
+		if repo == nil || *repo != tt.want {
+			t.Errorf("DetectRepository(%s) = %+v, want %+v", tt.dir, repo, tt.want)
+		}
+	}
+	if repo, err := histree.DetectRepository(root); err != nil || repo != nil {
+		t.Errorf("Expected no repository outside .git directories, got %+v (%v)", repo, err)
+	}
+
+	dbPath := filepath.Join(t.TempDir(), "repo.db")
+	add := func(dir, command string, args ...string) {
+		args = append([]string{"-db", dbPath, "-action", "add", "-dir", dir, "-hostname", "test-host", "-pid", "1"}, args...)
+		cmd := helperCommand(args...)
+		cmd.Stdin = strings.NewReader(command + "\n")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("add failed: %v: %s", err, out)
+		}
+	}
+	add(filepath.Join(root, "main/src/pkg"), "go test")
+	add(filepath.Join(root, "wt"), "git status")
+	add(filepath.Join(root, "detached"), "git log")
+	add(root, "ls")
+	add(filepath.Join(root, "main"), "untracked", "-git=false")
+	add("/elsewhere", "make", "-repo-root", "/elsewhere", "-branch", "main", "-remote", origin)
+
+	get := func(repo string) []histree.HistoryEntry {
+		out, err := helperCommand("-db", dbPath, "-action", "get", "-format", "json", "-repo", repo).Output()
+		if err != nil {
+			t.Fatalf("get -repo %s failed: %v", repo, err)
+		}
+		var entries []histree.HistoryEntry
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			if line == "" {
+				continue
+			}
+			var entry histree.HistoryEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("Failed to parse %q: %v", line, err)
+			}
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+	commands := func(entries []histree.HistoryEntry) string {
+		var got []string
+		for _, entry := range entries {
+			got = append(got, entry.Command)
+		}
+		return strings.Join(got, ",")
+	}
+
+	// Clones and worktrees share the remote
+	entries := get(filepath.Join(root, "wt"))
+	if got := commands(entries); got != "go test,git status,make" {
+		t.Errorf("get -repo worktree = %q", got)
+	}
+	if len(entries) > 0 && (entries[0].Repository == nil || *entries[0].Repository != tests[0].want) {
+		t.Errorf("Unexpected recorded repository: %+v", entries[0].Repository)
+	}
+	if got := commands(get(origin)); got != "go test,git status,make" {
+		t.Errorf("get -repo remote = %q", got)
+	}
+	if got := commands(get(filepath.Join(root, "detached"))); got != "git log" {
+		t.Errorf("get -repo detached = %q", got)
+	}
+	if out, err := helperCommand("-db", dbPath, "-action", "get", "-repo", root).CombinedOutput(); err == nil {
+		t.Errorf("Expected get -repo outside a repository to fail, got %q", out)
+	}
+
+	// A repository cloned elsewhere is found by its remote
+	write("clone/.git/HEAD", "ref: refs/heads/main\n")
+	write("clone/.git/config", config)
+	if err := os.RemoveAll(filepath.Join(root, "main")); err != nil {
+		t.Fatalf("Failed to remove repository: %v", err)
+	}
+
+	db, err := histree.OpenDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	moves, err := db.Reconcile(context.Background(), histree.ReconcileOptions{Roots: []string{root}, Hostname: "test-host"})
+	if err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+	var move histree.DirectoryMove
+	for _, m := range moves {
+		if m.OldPath == filepath.Join(root, "main") {
+			move = m
+		}
+	}
+	if move.NewPath != filepath.Join(root, "clone") || move.Reason != histree.MatchRemote {
+		t.Fatalf("Expected a move to the clone, got %+v", moves)
+	}
+
+	// Rewriting paths keeps the recorded repository roots in step
+	report, err := db.RewritePaths(context.Background(), move.OldPath, move.NewPath, histree.PathRewriteOptions{})
+	if err != nil {
+		t.Fatalf("Failed to rewrite paths: %v", err)
+	}
+	found, err := db.Find(context.Background(), histree.Query{Repository: filepath.Join(root, "clone"), Hostname: "test-host"})
+	if err != nil {
+		t.Fatalf("Failed to find entries: %v", err)
+	}
+	if len(found) != 1 || found[0].Command != "go test" {
+		t.Errorf("Expected the moved entry under the clone's root, got %+v", found)
+	}
+	if _, err := db.UndoPathRewrite(context.Background(), report.ID); err != nil {
+		t.Fatalf("Failed to undo rewrite: %v", err)
+	}
+	found, err = db.Find(context.Background(), histree.Query{Repository: filepath.Join(root, "main")})
+	if err != nil {
+		t.Fatalf("Failed to find entries: %v", err)
+	}
+	if len(found) != 1 {
+		t.Errorf("Expected undo to restore the repository root, got %+v", found)
+	}
+}
+
+// TestProjectScope tests scoping history to the project containing a directory
+func TestProjectScope(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"project/.git", "project/src/pkg", "project/tools/mod", "other"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatalf("Failed to create %s: %v", dir, err)
+		}
+	}
+	for _, file := range []string{"project/tools/mod/go.mod", "project/tools/mod/Makefile"} {
+		if err := os.WriteFile(filepath.Join(root, file), nil, 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", file, err)
+		}
+	}
+
+	if got := histree.FindProjectRoot(filepath.Join(root, "project/src/pkg"), histree.DefaultRootMarkers); got != filepath.Join(root, "project") {
+		t.Errorf("FindProjectRoot = %q", got)
+	}
+	if got := histree.FindProjectRoot(filepath.Join(root, "project/tools/mod"), histree.DefaultRootMarkers); got != filepath.Join(root, "project/tools/mod") {
+		t.Errorf("Expected the nearest marker to win, got %q", got)
+	}
+	if got := histree.FindProjectRoot(filepath.Join(root, "missing"), histree.DefaultRootMarkers); got != "" {
+		t.Errorf("Expected no root for a missing directory, got %q", got)
+	}
+
+	dbPath := filepath.Join(t.TempDir(), "project.db")
+	for _, e := range []struct{ dir, command string }{
+		{"project", "make"},
+		{"project/src/pkg", "go test"},
+		{"project/tools/mod", "go build"},
+		{"other", "ls"},
+	} {
+		cmd := helperCommand("-db", dbPath, "-action", "add", "-dir", filepath.Join(root, e.dir), "-hostname", "test-host", "-pid", "1")
+		cmd.Stdin = strings.NewReader(e.command + "\n")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("add failed: %v: %s", err, out)
+		}
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"subtree", []string{"-dir", filepath.Join(root, "project/src")}, "go test\n"},
+		{"dir", []string{"-dir", filepath.Join(root, "project"), "-scope", "dir"}, "make\n"},
+		{"project", []string{"-dir", filepath.Join(root, "project/src/pkg"), "-scope", "project"}, "make\ngo test\ngo build\n"},
+		{"nested project", []string{"-dir", filepath.Join(root, "project/tools/mod"), "-scope", "project"}, "go build\n"},
+		{"custom markers", []string{"-dir", filepath.Join(root, "project/tools/mod"), "-scope", "project", "-root-markers", ".git"}, "make\ngo test\ngo build\n"},
+		{"global", []string{"-dir", filepath.Join(root, "other"), "-scope", "global"}, "make\ngo test\ngo build\nls\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"-db", dbPath, "-action", "get"}, tt.args...)
+			out, err := helperCommand(args...).Output()
+			if err != nil {
+				t.Fatalf("get failed: %v", err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("got %q, want %q", out, tt.want)
+			}
+		})
+	}
+
+	if out, err := helperCommand("-db", dbPath, "-action", "get", "-scope", "tree").CombinedOutput(); err == nil {
+		t.Errorf("Expected an invalid scope to fail, got %q", out)
+	}
+}
+
+// TestAncestorScope tests inheriting history from parent directories
+func TestAncestorScope(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, e := range []struct{ dir, command string }{
+		{"/a", "make"},
+		{"/a/b", "go test"},
+		{"/a", "make clean"},
+		{"/a/b/c/d", "ls"},
+		{"/x", "vim"},
+		{"/a/bb", "cat"},
+	} {
+		entry := histree.HistoryEntry{Command: e.command, Directory: e.dir, Timestamp: base.Add(time.Duration(i) * time.Minute), Hostname: "test-host", ProcessID: 1}
+		if err := db.AddEntry(&entry); err != nil {
+			t.Fatalf("Failed to add entry: %v", err)
+		}
+	}
+
+	describe := func(entries []histree.HistoryEntry) string {
+		var got []string
+		for _, entry := range entries {
+			if entry.Distance == nil {
+				t.Fatalf("Entry %q has no distance", entry.Command)
+			}
+			got = append(got, fmt.Sprintf("%s:%d", entry.Command, *entry.Distance))
+		}
+		return strings.Join(got, ",")
+	}
+
+	tests := []struct {
+		name  string
+		query histree.Query
+		want  string
+	}{
+		{"oldest first", histree.Query{Directory: "/a/b/c"}, "make:2,make clean:2,go test:1"},
+		{"newest first", histree.Query{Directory: "/a/b/c/", Order: histree.OrderNewestFirst}, "go test:1,make clean:2,make:2"},
+		{"limit keeps nearest", histree.Query{Directory: "/a/b/c", Limit: 2}, "make clean:2,go test:1"},
+		{"own history", histree.Query{Directory: "/a/b/c/d", Limit: 1}, "ls:0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.query.DirMode = histree.DirAncestors
+			entries, err := db.Find(ctx, tt.query)
+			if err != nil {
+				t.Fatalf("Failed to find entries: %v", err)
+			}
+			if got := describe(entries); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	entries, err := db.Find(ctx, histree.Query{Directory: "/a/b/c", DirMode: histree.DirAncestors, Limit: 1})
+	if err != nil {
+		t.Fatalf("Failed to find entries: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := histree.WriteEntries(entries, &buf, histree.FormatVerbose); err != nil {
+		t.Fatalf("Failed to write entries: %v", err)
+	}
+	if !strings.Contains(buf.String(), "[/a/b ^1] go test") {
+		t.Errorf("Expected the ancestor distance in verbose output, got %q", buf.String())
+	}
+	buf.Reset()
+	if err := histree.WriteEntries(entries, &buf, histree.FormatJSON); err != nil {
+		t.Fatalf("Failed to write entries: %v", err)
+	}
+	if !strings.Contains(buf.String(), `"directory":"/a/b"`) || !strings.Contains(buf.String(), `"distance":1`) {
+		t.Errorf("Expected the ancestor and distance in JSON output, got %q", buf.String())
+	}
+
+	// Other modes leave the distance unset
+	entries, err = db.Find(ctx, histree.Query{Directory: "/a"})
+	if err != nil {
+		t.Fatalf("Failed to find entries: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.Distance != nil {
+			t.Errorf("Unexpected distance for %q", entry.Command)
+		}
+	}
+}
+
+func TestRankedEntries(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	now := time.Now().UTC()
+	for _, e := range []struct {
+		dir, command string
+		age          time.Duration
+	}{
+		{"/p", "git status", 30 * 24 * time.Hour},
+		{"/p", "make", 40 * time.Minute},
+		{"/p/sub", "git status", 48 * time.Hour},
+		{"/p", "make", 30 * time.Minute},
+		{"/p", "git status", 10 * time.Minute},
+		{"/p", "ls", 5 * time.Minute},
+		{"/other", "vim", time.Minute},
+	} {
+		entry := histree.HistoryEntry{Command: e.command, Directory: e.dir, Timestamp: now.Add(-e.age), Hostname: "test-host", ProcessID: 1}
+		if err := db.AddEntry(&entry); err != nil {
+			t.Fatalf("Failed to add entry: %v", err)
+		}
+	}
+
+	commands := func(entries []histree.HistoryEntry) string {
+		var got []string
+		for _, entry := range entries {
+			got = append(got, entry.Command)
+		}
+		return strings.Join(got, ",")
+	}
+
+	// Unique keeps the latest occurrence of each command
+	entries, err := db.Find(ctx, histree.Query{Directory: "/p", Unique: true})
+	if err != nil {
+		t.Fatalf("Failed to find entries: %v", err)
+	}
+	if got := commands(entries); got != "make,git status,ls" {
+		t.Errorf("got %s, want make,git status,ls", got)
+	}
+	if !entries[1].Timestamp.Equal(now.Add(-10 * time.Minute)) {
+		t.Errorf("Expected the latest git status, got %v", entries[1].Timestamp)
+	}
+
+	entries, err = db.Find(ctx, histree.Query{Directory: "/p", SortBy: histree.SortFrecency, Order: histree.OrderNewestFirst})
+	if err != nil {
+		t.Fatalf("Failed to find entries: %v", err)
+	}
+	if got := commands(entries); got != "make,git status,ls" {
+		t.Errorf("got %s, want make,git status,ls", got)
+	}
+
+	ranked, err := db.RankedEntries(ctx, histree.Query{Directory: "/p", SortBy: histree.SortFrecency, Limit: 2})
+	if err != nil {
+		t.Fatalf("Failed to get ranked entries: %v", err)
+	}
+	if len(ranked) != 2 {
+		t.Fatalf("Expected 2 ranked entries, got %d", len(ranked))
+	}
+	for i, want := range []struct {
+		command string
+		count   int
+		score   float64
+	}{
+		{"git status", 3, 4.75},
+		{"make", 2, 8},
+	} {
+		got := ranked[i]
+		if got.Command != want.command || got.Count != want.count || got.Score != want.score {
+			t.Errorf("ranked[%d] = %s x%d (%v), want %s x%d (%v)", i, got.Command, got.Count, got.Score, want.command, want.count, want.score)
+		}
+		if !got.LastUsed.Equal(got.Timestamp) {
+			t.Errorf("ranked[%d] last used %v, want %v", i, got.LastUsed, got.Timestamp)
+		}
+	}
+
+	// The scope limits which occurrences are counted
+	ranked, err = db.RankedEntries(ctx, histree.Query{Directory: "/p/sub"})
+	if err != nil {
+		t.Fatalf("Failed to get ranked entries: %v", err)
+	}
+	if len(ranked) != 1 || ranked[0].Count != 1 {
+		t.Errorf("Expected a single git status in /p/sub, got %+v", ranked)
+	}
+
+	cmd := helperCommand("-db", "./test_histree.db", "-action", "get", "-dir", "/p", "-sort", "frecency", "-format", "json", "-limit", "1")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	var entry struct {
+		Command string `json:"command"`
+		Count   int    `json:"count"`
+	}
+	if err := json.Unmarshal(out, &entry); err != nil {
+		t.Fatalf("Failed to decode %q: %v", out, err)
+	}
+	if entry.Command != "make" || entry.Count != 2 {
+		t.Errorf("Expected make run twice, got %+v", entry)
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, e := range []struct {
+		pid          int
+		dir, command string
+	}{
+		{1, "/p", "git add ."},
+		{2, "/q", "make"},
+		{1, "/p", "git commit"},
+		{2, "/q", "git add ."},
+		{1, "/p", "git push"},
+		{2, "/q", "git commit"},
+		{1, "/p", "git add ."},
+		{2, "/q", "git log"},
+		{1, "/p", "git commit"},
+		{1, "/p", "git push"},
+		{3, "/p/sub", "ls"},
+		{3, "/p/sub", "git commit"},
+		{3, "/p/sub", "git status"},
+		{4, "/p", "git add ."},
+		{4, "/p", "git commit"},
+	} {
+		entry := histree.HistoryEntry{Command: e.command, Directory: e.dir, Timestamp: base.Add(time.Duration(i) * time.Minute), Hostname: "test-host", ProcessID: e.pid}
+		if err := db.AddEntry(&entry); err != nil {
+			t.Fatalf("Failed to add entry: %v", err)
+		}
+	}
+
+	describe := func(suggestions []histree.Suggestion) string {
+		var got []string
+		for _, s := range suggestions {
+			got = append(got, fmt.Sprintf("%s:%d:%.3f", s.Command, s.Count, s.Score))
+		}
+		return strings.Join(got, ",")
+	}
+
+	previous := []string{"ls", "git add .", "git commit"}
+	tests := []struct {
+		name string
+		req  histree.SuggestRequest
+		want string
+	}{
+		{"sequence", histree.SuggestRequest{Previous: previous[1:]}, "git push:2:0.571,git log:1:0.286,git status:1:0.143"},
+		{"directory", histree.SuggestRequest{Previous: previous[1:], Directory: "/p"}, "git push:2:0.667,git status:1:0.167,git log:1:0.167"},
+		{"longer context", histree.SuggestRequest{Previous: previous}, "git push:2:0.571,git log:1:0.286,git status:1:0.143"},
+		{"last command", histree.SuggestRequest{Previous: []string{"git commit"}}, "git push:2:0.500,git status:1:0.250,git log:1:0.250"},
+		{"prefix", histree.SuggestRequest{Previous: previous[1:], Prefix: "git s"}, "git status:1:1.000"},
+		{"limit", histree.SuggestRequest{Previous: previous[1:], Limit: 1}, "git push:2:0.571"},
+		{"shell history", histree.SuggestRequest{Hostname: "test-host", ProcessID: 4}, "git push:2:0.571,git log:1:0.286,git status:1:0.143"},
+		{"unknown sequence", histree.SuggestRequest{Previous: []string{"vim"}}, ""},
+		{"no context", histree.SuggestRequest{Prefix: "git c"}, "git commit:5:1.000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			suggestions, err := db.Suggest(ctx, tt.req)
+			if err != nil {
+				t.Fatalf("Failed to suggest commands: %v", err)
+			}
+			if got := describe(suggestions); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	suggestions, err := db.Suggest(ctx, histree.SuggestRequest{Previous: previous[1:], Limit: 1})
+	if err != nil {
+		t.Fatalf("Failed to suggest commands: %v", err)
+	}
+	if want := base.Add(9 * time.Minute); !suggestions[0].LastUsed.Equal(want) {
+		t.Errorf("Expected git push last used at %v, got %v", want, suggestions[0].LastUsed)
+	}
+
+	out, err := helperCommand("-db", "./test_histree.db", "-action", "suggest", "-limit", "1", "git add .", "git commit").Output()
+	if err != nil {
+		t.Fatalf("suggest failed: %v", err)
+	}
+	var suggestion histree.Suggestion
+	if err := json.Unmarshal(out, &suggestion); err != nil {
+		t.Fatalf("Failed to decode %q: %v", out, err)
+	}
+	if suggestion.Command != "git push" || suggestion.Count != 2 {
+		t.Errorf("Expected git push, got %+v", suggestion)
+	}
+}
+
+func TestImporters(t *testing.T) {
+	unknown := importer.UnknownTime
+	at := func(sec int64) time.Time { return time.Unix(sec, 0).UTC() }
+
+	tests := []struct {
+		name  string
+		parse func(io.Reader) ([]histree.HistoryEntry, error)
+		input string
+		want  []histree.HistoryEntry
+	}{
+		{
+			name:  "bash",
+			parse: importer.ParseBash,
+			input: "ls\n\necho hi\n",
+			want: []histree.HistoryEntry{
+				{Command: "ls", Timestamp: unknown},
+				{Command: "echo hi", Timestamp: unknown},
+			},
+		},
+		{
+			name:  "bash with timestamps",
+			parse: importer.ParseBash,
+			input: "#1700000000\nls\n#1700000060\nfor f in *; do\n  echo $f\ndone\n#1700000120\n#comment\n",
+			want: []histree.HistoryEntry{
+				{Command: "ls", Timestamp: at(1700000000)},
+				{Command: "for f in *; do\n  echo $f\ndone", Timestamp: at(1700000060)},
+				{Command: "#comment", Timestamp: at(1700000120)},
+			},
+		},
+		{
+			name:  "zsh",
+			parse: importer.ParseZsh,
+			input: ": 1700000000:3;make\n: 1700000010:0;echo one\\\ntwo\nplain\n: 1700000020:0;caf\x83\xa3\n",
+			want: []histree.HistoryEntry{
+				{Command: "make", Timestamp: at(1700000003), Duration: 3 * time.Second},
+				{Command: "echo one\ntwo", Timestamp: at(1700000010)},
+				{Command: "plain", Timestamp: unknown},
+				{Command: "caf\x83", Timestamp: at(1700000020)},
+			},
+		},
+		{
+			name:  "fish",
+			parse: importer.ParseFish,
+			input: "- cmd: git status\n  when: 1700000000\n- cmd: echo a\\nb \\\\n\n  when: 1700000060\n  paths:\n    - b\n- cmd: ls\n",
+			want: []histree.HistoryEntry{
+				{Command: "git status", Timestamp: at(1700000000)},
+				{Command: "echo a\nb \\n", Timestamp: at(1700000060)},
+				{Command: "ls", Timestamp: unknown},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := tt.parse(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatalf("Failed to parse: %v", err)
+			}
+			if len(entries) != len(tt.want) {
+				t.Fatalf("Expected %d entries, got %+v", len(tt.want), entries)
+			}
+			for i, want := range tt.want {
+				got := entries[i]
+				if got.Command != want.Command || !got.Timestamp.Equal(want.Timestamp) || got.Duration != want.Duration {
+					t.Errorf("entries[%d] = %q at %v (%v), want %q at %v (%v)", i, got.Command, got.Timestamp, got.Duration, want.Command, want.Timestamp, want.Duration)
+				}
+				if got.Directory != "" || got.ExitCode != histree.ExitCodeUnknown {
+					t.Errorf("entries[%d] has directory %q and exit code %d, want both unknown", i, got.Directory, got.ExitCode)
+				}
+			}
+		})
+	}
+}
+
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "histree.db")
+
+	zshHistory := filepath.Join(dir, "zsh_history")
+	if err := os.WriteFile(zshHistory, []byte(": 1700000000:1;make\nls\nls\n"), 0600); err != nil {
+		t.Fatalf("Failed to write history: %v", err)
+	}
+
+	// An atuin database with one deleted command
+	atuinPath := filepath.Join(dir, "atuin.db")
+	atuin, err := sql.Open("sqlite3", atuinPath)
+	if err != nil {
+		t.Fatalf("Failed to create atuin database: %v", err)
+	}
+	_, err = atuin.Exec(`
+		CREATE TABLE history (id TEXT PRIMARY KEY, timestamp INTEGER, duration INTEGER, exit INTEGER, command TEXT, cwd TEXT, session TEXT, hostname TEXT, deleted_at INTEGER);
+		INSERT INTO history VALUES ('a', 1700000100000000000, 2500000000, 1, 'go test ./...', '/src/app', 's', 'laptop:me', NULL);
+		INSERT INTO history VALUES ('b', 1700000200000000000, -1, 0, 'rm -rf /', '/', 's', 'laptop:me', 1700000300000000000);`)
+	atuin.Close()
+	if err != nil {
+		t.Fatalf("Failed to fill atuin database: %v", err)
+	}
+
+	importHistory := func(args ...string) string {
+		args = append([]string{"-db", dbPath, "-action", "import", "-hostname", "test-host"}, args...)
+		out, err := helperCommand(args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("import failed: %v\n%s", err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	if got, want := importHistory("-from", "zsh", "-file", zshHistory), "Imported 3 of 3 entries from "+zshHistory; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := importHistory("-from", "zsh", "-file", zshHistory), "Imported 0 of 3 entries from "+zshHistory; got != want {
+		t.Errorf("Expected a re-import to add nothing: got %q, want %q", got, want)
+	}
+	if got, want := importHistory("-from", "atuin", "-file", atuinPath), "Imported 1 of 1 entries from "+atuinPath; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if out, err := helperCommand("-db", dbPath, "-action", "import", "-from", "csh").CombinedOutput(); err == nil {
+		t.Errorf("Expected an unknown format to fail, got %s", out)
+	}
+
+	db, err := histree.OpenDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	entries, err := db.Find(context.Background(), histree.Query{})
+	if err != nil {
+		t.Fatalf("Failed to find entries: %v", err)
+	}
+	var got []string
+	for _, entry := range entries {
+		got = append(got, fmt.Sprintf("%s|%s|%s|%d|%s", entry.Command, entry.Directory, entry.Hostname, entry.ExitCode, entry.Duration))
+	}
+	want := []string{
+		"ls||test-host|-1|0s",
+		"ls||test-host|-1|0s",
+		"make||test-host|-1|1s",
+		"go test ./...|/src/app|laptop|1|2.5s",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Unknown exit codes are not failures
+	entries, err = db.Find(context.Background(), histree.Query{FailedOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to find entries: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Command != "go test ./..." {
+		t.Errorf("Expected only go test to have failed, got %+v", entries)
+	}
+}
+
+func TestShellHistoryFormats(t *testing.T) {
+	startedAt := time.Unix(1700000000, 0).UTC()
+	entries := []histree.HistoryEntry{
+		{Command: "make", Timestamp: startedAt.Add(3 * time.Second), StartedAt: &startedAt, Duration: 3 * time.Second},
+		{Command: "for f in *; do\n  echo \"$f\\n\"\ndone", Timestamp: time.Unix(1700000060, 0).UTC()},
+		{Command: "echo caf\x83", Timestamp: time.Unix(1700000120, 0).UTC()},
+	}
+
+	tests := []struct {
+		format histree.OutputFormat
+		parse  func(io.Reader) ([]histree.HistoryEntry, error)
+		want   string
+	}{
+		{histree.FormatZsh, importer.ParseZsh, ": 1700000000:3;make\n: 1700000060:0;for f in *; do\\\n  echo \"$f\\n\"\\\ndone\n: 1700000120:0;echo caf\x83\xa3\n"},
+		{histree.FormatBash, importer.ParseBash, "#1700000000\nmake\n#1700000060\nfor f in *; do\n  echo \"$f\\n\"\ndone\n#1700000120\necho caf\x83\n"},
+		{histree.FormatFish, importer.ParseFish, "- cmd: make\n  when: 1700000000\n- cmd: for f in *; do\\n  echo \"$f\\\\n\"\\ndone\n  when: 1700000060\n- cmd: echo caf\x83\n  when: 1700000120\n"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := histree.WriteEntries(entries, &buf, tt.format); err != nil {
+				t.Fatalf("Failed to write entries: %v", err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("got %q, want %q", buf.String(), tt.want)
+			}
+
+			// The shell must read back the same commands and start times
+			parsed, err := tt.parse(&buf)
+			if err != nil {
+				t.Fatalf("Failed to parse output: %v", err)
+			}
+			if len(parsed) != len(entries) {
+				t.Fatalf("Expected %d entries, got %+v", len(entries), parsed)
+			}
+			for i, entry := range entries {
+				start := entry.Timestamp
+				if entry.StartedAt != nil {
+					start = *entry.StartedAt
+				}
+				got := parsed[i].Timestamp
+				if parsed[i].StartedAt != nil {
+					got = *parsed[i].StartedAt
+				}
+				if parsed[i].Command != entry.Command || !got.Equal(start) {
+					t.Errorf("parsed[%d] = %q at %v, want %q at %v", i, parsed[i].Command, got, entry.Command, start)
+				}
+			}
+		})
+	}
+}
+
+func TestTableFormats(t *testing.T) {
+	startedAt := time.Date(2024, 2, 15, 15, 3, 0, 0, time.UTC)
+	entries := []histree.HistoryEntry{
+		{Command: "echo \"a, b\"\necho\tc\\d", Directory: "/tmp", Timestamp: startedAt.Add(1500 * time.Millisecond), ExitCode: 1, Hostname: "host", ProcessID: 42, StartedAt: &startedAt, Duration: 1500 * time.Millisecond},
+		{Command: "ls", Directory: "/home/user", Timestamp: time.Date(2024, 2, 15, 15, 4, 30, 0, time.UTC), Hostname: "host", ProcessID: 42, SessionID: "s1"},
+	}
+
+	write := func(format histree.OutputFormat, entries []histree.HistoryEntry) string {
+		var buf bytes.Buffer
+		if err := histree.WriteEntries(entries, &buf, format); err != nil {
+			t.Fatalf("Failed to write entries: %v", err)
+		}
+		return buf.String()
+	}
+
+	records, err := csv.NewReader(strings.NewReader(write(histree.FormatCSV, entries))).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read CSV: %v", err)
+	}
+	want := [][]string{
+		{"timestamp", "directory", "exit_code", "duration_ms", "hostname", "process_id", "session_id", "command"},
+		{"2024-02-15T15:03:01.5Z", "/tmp", "1", "1500", "host", "42", "", entries[0].Command},
+		{"2024-02-15T15:04:30Z", "/home/user", "0", "", "host", "42", "s1", "ls"},
+	}
+	if fmt.Sprintf("%q", records) != fmt.Sprintf("%q", want) {
+		t.Errorf("got %q, want %q", records, want)
+	}
+
+	wantTSV := "timestamp\tdirectory\texit_code\tduration_ms\thostname\tprocess_id\tsession_id\tcommand\n" +
+		"2024-02-15T15:03:01.5Z\t/tmp\t1\t1500\thost\t42\t\techo \"a, b\"\\necho\\tc\\\\d\n" +
+		"2024-02-15T15:04:30Z\t/home/user\t0\t\thost\t42\ts1\tls\n"
+	if got := write(histree.FormatTSV, entries); got != wantTSV {
+		t.Errorf("got %q, want %q", got, wantTSV)
+	}
+
+	if got, want := write(histree.FormatNull, entries), entries[0].Command+"\x00ls\x00"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The header is written even without entries
+	if got := write(histree.FormatCSV, nil); got != "timestamp,directory,exit_code,duration_ms,hostname,process_id,session_id,command\n" {
+		t.Errorf("Expected only the header, got %q", got)
+	}
+	if got := write(histree.FormatNull, nil); got != "" {
+		t.Errorf("Expected no output, got %q", got)
+	}
+}
+
+// writeUpper is a custom format writing commands in upper case
+func writeUpper(w io.Writer, entry histree.HistoryEntry) error {
+	_, err := fmt.Fprintln(w, strings.ToUpper(entry.Command))
+	return err
+}
+
+func TestTemplateFormat(t *testing.T) {
+	t.Setenv("HOME", "/home/user")
+
+	started := time.Now().Add(-5*time.Minute - 2*time.Second)
+	entries := []histree.HistoryEntry{
+		{Command: "make", Directory: "/home/user/src", Timestamp: started.Add(2 * time.Second), ExitCode: 2, Duration: 2 * time.Second},
+		{Command: "ls", Directory: "/home/username", Timestamp: time.Date(2024, 2, 15, 15, 4, 30, 0, time.UTC)},
+	}
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{`{{.Timestamp | date "2006-01-02"}} {{.ExitCode}} {{.Command}}`, started.Format("2006-01-02") + " 2 make\n2024-02-15 0 ls\n"},
+		{`{{.Directory | tilde}}`, "~/src\n/home/username\n"},
+		{`{{if .ExitCode}}{{.Command | color "red"}}{{else}}{{.Command}}{{end}}`, "\x1b[31mmake\x1b[0m\nls\n"},
+		{`{{.Duration | duration}}`, "2s\n0s\n"},
+	}
+	for _, tt := range tests {
+		formatter, err := histree.NewTemplateFormatter(tt.text)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", tt.text, err)
+		}
+		var buf bytes.Buffer
+		for _, entry := range entries {
+			if err := formatter.WriteEntry(&buf, entry); err != nil {
+				t.Fatalf("Failed to write %q: %v", tt.text, err)
+			}
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.text, buf.String(), tt.want)
+		}
+	}
+
+	formatter, err := histree.NewTemplateFormatter(`{{.Timestamp | ago}}`)
+	if err != nil {
+		t.Fatalf("Failed to parse template: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := formatter.WriteEntry(&buf, entries[0]); err != nil {
+		t.Fatalf("Failed to write entry: %v", err)
+	}
+	if buf.String() != "5m ago\n" {
+		t.Errorf("got %q, want %q", buf.String(), "5m ago\n")
+	}
+
+	if _, err := histree.NewTemplateFormatter(`{{.Command`); err == nil {
+		t.Error("Expected an invalid template to fail")
+	}
+	formatter, err = histree.NewTemplateFormatter(`{{.Command | color "mauve"}}`)
+	if err != nil {
+		t.Fatalf("Failed to parse template: %v", err)
+	}
+	if err := formatter.WriteEntry(io.Discard, entries[0]); err == nil {
+		t.Error("Expected an unknown color to fail")
+	}
+
+	// Registered formats are available by name
+	if err := histree.WriteEntries(entries, io.Discard, "upper"); err == nil {
+		t.Error("Expected an unregistered format to fail")
+	}
+	histree.RegisterFormat("upper", func() histree.Formatter { return histree.FormatterFunc(writeUpper) })
+	buf.Reset()
+	if err := histree.WriteEntries(entries, &buf, "upper"); err != nil {
+		t.Fatalf("Failed to write entries: %v", err)
+	}
+	if buf.String() != "MAKE\nLS\n" {
+		t.Errorf("got %q, want %q", buf.String(), "MAKE\nLS\n")
+	}
+
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	for i := range entries {
+		entries[i].Hostname, entries[i].ProcessID = "test-host", 1
+		if err := db.AddEntry(&entries[i]); err != nil {
+			t.Fatalf("Failed to add entry: %v", err)
+		}
+	}
+	out, err := helperCommand("-db", "./test_histree.db", "-action", "get", "-format", "template", "-template", "{{.ExitCode}} {{.Command}}").CombinedOutput()
+	if err != nil {
+		t.Fatalf("get failed: %v\n%s", err, out)
+	}
+	if string(out) != "0 ls\n2 make\n" {
+		t.Errorf("got %q, want %q", out, "0 ls\n2 make\n")
+	}
+	if out, err := helperCommand("-db", "./test_histree.db", "-action", "get", "-format", "template").CombinedOutput(); err == nil {
+		t.Errorf("Expected -format template without -template to fail, got %s", out)
+	}
+}
+
+// countingFormatter is a custom format with a header and footer
+type countingFormatter struct {
+	count int
+}
+
+func (f *countingFormatter) Begin(w io.Writer) error {
+	_, err := io.WriteString(w, "BEGIN\n")
+	return err
+}
+
+func (f *countingFormatter) WriteEntry(w io.Writer, entry histree.HistoryEntry) error {
+	f.count++
+	_, err := fmt.Fprintf(w, "%d. %s\n", f.count, entry.Command)
+	return err
+}
+
+func (f *countingFormatter) End(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "END (%d)\n", f.count)
+	return err
+}
+
+func TestFormatters(t *testing.T) {
+	entries := []histree.HistoryEntry{
+		{Command: "echo '<b>' | wc -c\necho done", Directory: "/tmp", Timestamp: time.Date(2024, 2, 15, 15, 4, 30, 0, time.UTC), ExitCode: 1, Duration: 1500 * time.Millisecond},
+		{Command: "ls", Directory: "/home/user", Timestamp: time.Date(2024, 2, 15, 15, 5, 0, 0, time.UTC), ExitCode: histree.ExitCodeUnknown},
+	}
+
+	write := func(format histree.OutputFormat, entries []histree.HistoryEntry) string {
+		var buf bytes.Buffer
+		if err := histree.WriteEntries(entries, &buf, format); err != nil {
+			t.Fatalf("Failed to write %s: %v", format, err)
+		}
+		return buf.String()
+	}
+	// Times are shown in the local timezone
+	first := entries[0].Timestamp.Local().Format("2006-01-02T15:04:05")
+	second := entries[1].Timestamp.Local().Format("2006-01-02T15:04:05")
+
+	var decoded []histree.HistoryEntry
+	if err := json.Unmarshal([]byte(write(histree.FormatJSONArray, entries)), &decoded); err != nil {
+		t.Fatalf("Failed to decode JSON array: %v", err)
+	}
+	if len(decoded) != 2 || decoded[0].Command != entries[0].Command || decoded[1].Command != "ls" {
+		t.Errorf("Unexpected JSON array %+v", decoded)
+	}
+	if got := write(histree.FormatJSONArray, nil); got != "[]\n" {
+		t.Errorf("Expected an empty array, got %q", got)
+	}
+
+	wantHTML := "<table>\n<thead>\n<tr><th>Time</th><th>Directory</th><th>Exit</th><th>Duration</th><th>Command</th></tr>\n</thead>\n<tbody>\n" +
+		"<tr><td>" + first + "</td><td>/tmp</td><td>1</td><td>1.5s</td><td><code>echo &#39;&lt;b&gt;&#39; | wc -c\necho done</code></td></tr>\n" +
+		"<tr><td>" + second + "</td><td>/home/user</td><td></td><td></td><td><code>ls</code></td></tr>\n" +
+		"</tbody>\n</table>\n"
+	if got := write(histree.FormatHTML, entries); got != wantHTML {
+		t.Errorf("got %q, want %q", got, wantHTML)
+	}
+
+	wantMarkdown := "| Time | Directory | Exit | Duration | Command |\n| --- | --- | ---: | ---: | --- |\n" +
+		"| " + first + " | /tmp | 1 | 1.5s | echo '<b>' \\| wc -c<br>echo done |\n" +
+		"| " + second + " | /home/user |  |  | ls |\n"
+	if got := write(histree.FormatMarkdown, entries); got != wantMarkdown {
+		t.Errorf("got %q, want %q", got, wantMarkdown)
+	}
+
+	// Each output gets a new formatter, which begins and ends even
+	// without entries
+	histree.RegisterFormat("counting", func() histree.Formatter { return &countingFormatter{} })
+	if got, want := write("counting", entries), "BEGIN\n1. "+entries[0].Command+"\n2. ls\nEND (2)\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := write("counting", nil); got != "BEGIN\nEND (0)\n" {
+		t.Errorf("got %q, want %q", got, "BEGIN\nEND (0)\n")
+	}
+
+	formats := fmt.Sprint(histree.Formats())
+	for _, name := range []histree.OutputFormat{histree.FormatJSON, histree.FormatHTML, histree.FormatMarkdown, "counting"} {
+		if !strings.Contains(formats, string(name)) {
+			t.Errorf("Expected %s among the formats, got %s", name, formats)
+		}
+	}
+	if _, err := histree.NewFormatter("yaml"); err == nil {
+		t.Error("Expected an unknown format to fail")
+	}
+}
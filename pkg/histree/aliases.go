@@ -0,0 +1,212 @@
+package histree
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrAliasNotFound is returned when removing an alias that does not exist
+var ErrAliasNotFound = errors.New("directory alias not found")
+
+// DirectoryAlias maps the directory prefix Alias to the canonical prefix
+// Canonical. Queries for a directory also match the entries recorded under
+// every path it is an alias of, or that is an alias of it, so history
+// survives moved projects, symlinked home directories and differing mount
+// points without rewriting any rows.
+type DirectoryAlias struct {
+	Alias     string    `json:"alias"`
+	Canonical string    `json:"canonical"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func migrateCreateAliases(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS directory_aliases (
+			alias TEXT PRIMARY KEY,
+			canonical TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create directory_aliases table: %w", err)
+	}
+	return nil
+}
+
+// AddAlias makes alias and its subdirectories resolve to canonical. Adding
+// an existing alias again replaces its canonical prefix.
+func (db *DB) AddAlias(ctx context.Context, alias, canonical string) error {
+	alias = trimTrailingSlash(alias)
+	canonical = trimTrailingSlash(canonical)
+	if alias == "" || canonical == "" {
+		return errors.New("both alias and canonical paths are required")
+	}
+
+	return db.withRetry(ctx, func() error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer tx.Rollback()
+
+		aliases, err := loadAliases(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		// Refuse aliases that would make a path resolve to itself
+		var others []DirectoryAlias
+		for _, a := range aliases {
+			if a.Alias != alias {
+				others = append(others, a)
+			}
+		}
+		if resolved := canonicalize(canonical, others); isUnder(resolved, alias) {
+			return fmt.Errorf("alias %s -> %s would create a cycle", alias, canonical)
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO directory_aliases (alias, canonical, created_at) VALUES (?, ?, ?)
+			ON CONFLICT (alias) DO UPDATE SET canonical = excluded.canonical, created_at = excluded.created_at`,
+			alias, canonical, db.now().UTC(),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to add alias: %w", err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		return nil
+	})
+}
+
+// RemoveAlias deletes the alias for the given prefix
+func (db *DB) RemoveAlias(ctx context.Context, alias string) error {
+	alias = trimTrailingSlash(alias)
+
+	var result sql.Result
+	err := db.withRetry(ctx, func() error {
+		var err error
+		result, err = db.ExecContext(ctx, "DELETE FROM directory_aliases WHERE alias = ?", alias)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove alias: %w", err)
+	}
+
+	if count, _ := result.RowsAffected(); count == 0 {
+		return fmt.Errorf("%w: %s", ErrAliasNotFound, alias)
+	}
+	return nil
+}
+
+// Aliases returns every directory alias ordered by alias path
+func (db *DB) Aliases(ctx context.Context) ([]DirectoryAlias, error) {
+	return loadAliases(ctx, db.DB)
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func loadAliases(ctx context.Context, q queryer) ([]DirectoryAlias, error) {
+	rows, err := q.QueryContext(ctx, "SELECT alias, canonical, created_at FROM directory_aliases ORDER BY alias")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query aliases: %w", err)
+	}
+	defer rows.Close()
+
+	aliases := []DirectoryAlias{}
+	for rows.Next() {
+		var alias DirectoryAlias
+		if err := rows.Scan(&alias.Alias, &alias.Canonical, &alias.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		aliases = append(aliases, alias)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during row iteration: %w", err)
+	}
+	return aliases, nil
+}
+
+// expandDirectory returns dir together with every path that resolves to the
+// same canonical directory. In DirSubtree mode it also returns aliases whose
+// canonical prefix lies inside dir, since their entries belong to its subtree.
+func (db *DB) expandDirectory(ctx context.Context, dir string, mode DirMode) ([]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	aliases, err := loadAliases(ctx, db.DB)
+	if err != nil {
+		return nil, err
+	}
+	if len(aliases) == 0 {
+		return []string{dir}, nil
+	}
+
+	seen := map[string]bool{dir: true}
+	queue := []string{canonicalize(trimTrailingSlash(dir), aliases)}
+	seen[queue[0]] = true
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+		for _, a := range aliases {
+			var expanded string
+			switch {
+			case isUnder(path, a.Canonical):
+				expanded = a.Alias + strings.TrimPrefix(path, a.Canonical)
+			case mode == DirSubtree && isUnder(a.Canonical, path):
+				expanded = a.Alias
+			default:
+				continue
+			}
+			if !seen[expanded] {
+				seen[expanded] = true
+				queue = append(queue, expanded)
+			}
+		}
+	}
+
+	dirs := make([]string, 0, len(seen))
+	for path := range seen {
+		dirs = append(dirs, path)
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// canonicalize repeatedly replaces the longest alias prefix of path with its
+// canonical prefix
+func canonicalize(path string, aliases []DirectoryAlias) string {
+	// Each alias applies at most once, so cycles cannot loop forever
+	for i := 0; i < len(aliases); i++ {
+		var best *DirectoryAlias
+		for j := range aliases {
+			if isUnder(path, aliases[j].Alias) && (best == nil || len(aliases[j].Alias) > len(best.Alias)) {
+				best = &aliases[j]
+			}
+		}
+		if best == nil {
+			break
+		}
+		path = best.Canonical + strings.TrimPrefix(path, best.Alias)
+	}
+	return path
+}
+
+// isUnder reports whether path is dir or one of its subdirectories
+func isUnder(path, dir string) bool {
+	if dir == "/" {
+		return strings.HasPrefix(path, "/")
+	}
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
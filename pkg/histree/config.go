@@ -0,0 +1,328 @@
+package histree
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// DefaultBusyTimeout is how long SQLite waits for a lock held by another
+// connection before reporting the database as busy
+const DefaultBusyTimeout = 5 * time.Second
+
+// Defaults applied to zero Config fields
+const (
+	DefaultJournalMode = "WAL"
+	DefaultSynchronous = "NORMAL"
+	DefaultCacheSize   = -2000
+)
+
+// DefaultRetryPolicy is the RetryPolicy used when Config.Retry is left zero
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    10,
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     500 * time.Millisecond,
+}
+
+// RetryPolicy controls how write operations are retried when the database
+// stays locked by another connection for longer than the busy timeout
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	// Zero selects DefaultRetryPolicy; one disables retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry. It doubles after
+	// every attempt up to MaxBackoff, with random jitter added.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// Logger receives diagnostic messages such as applied migrations and lock
+// retries. *log.Logger satisfies this interface.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// Config describes how to open a histree database. Zero fields select the
+// documented defaults.
+type Config struct {
+	// Path is the SQLite database file, or a "file:" URI
+	Path string
+
+	// ReadOnly opens the database without write access. The database is
+	// never created, no pragmas that modify the file are set, and instead
+	// of migrating, opening fails with ErrSchemaMissing or
+	// ErrSchemaOutdated if the schema is not current.
+	ReadOnly bool
+	// Immutable additionally tells SQLite the file cannot change while it
+	// is open, so no locks or -shm files are needed. Use it for databases
+	// on read-only media such as snapshots. It implies ReadOnly.
+	Immutable bool
+
+	// JournalMode is the SQLite journal mode (DELETE, TRUNCATE, PERSIST,
+	// MEMORY, WAL or OFF). Zero selects DefaultJournalMode.
+	JournalMode string
+	// Synchronous is the SQLite synchronous level (OFF, NORMAL, FULL or
+	// EXTRA). Zero selects DefaultSynchronous.
+	Synchronous string
+	// CacheSize is the page cache size; negative values are in KiB as for
+	// PRAGMA cache_size. Zero selects DefaultCacheSize.
+	CacheSize int
+
+	// BusyTimeout is how long a statement waits on a lock held by another
+	// connection. Zero selects DefaultBusyTimeout.
+	BusyTimeout time.Duration
+	// Retry controls retries of writes that still fail with "database is
+	// locked" after BusyTimeout
+	Retry RetryPolicy
+
+	// SkipMigrations leaves the schema untouched. The caller is responsible
+	// for the database already having an up-to-date schema.
+	SkipMigrations bool
+
+	// Clock returns the current time. It timestamps entries added without
+	// one and names backups. Zero selects time.Now.
+	Clock func() time.Time
+	// Logger receives diagnostic messages. Nil discards them.
+	Logger Logger
+}
+
+// Option configures how OpenDB opens a database
+type Option func(*Config)
+
+// WithReadOnly opens the database without write access
+func WithReadOnly() Option {
+	return func(cfg *Config) { cfg.ReadOnly = true }
+}
+
+// WithImmutable opens the database read-only, assuming it cannot change while open
+func WithImmutable() Option {
+	return func(cfg *Config) {
+		cfg.ReadOnly = true
+		cfg.Immutable = true
+	}
+}
+
+// WithJournalMode sets the SQLite journal mode
+func WithJournalMode(mode string) Option {
+	return func(cfg *Config) { cfg.JournalMode = mode }
+}
+
+// WithSynchronous sets the SQLite synchronous level
+func WithSynchronous(level string) Option {
+	return func(cfg *Config) { cfg.Synchronous = level }
+}
+
+// WithCacheSize sets the SQLite page cache size
+func WithCacheSize(size int) Option {
+	return func(cfg *Config) { cfg.CacheSize = size }
+}
+
+// WithBusyTimeout sets how long statements wait on locks held by other connections
+func WithBusyTimeout(d time.Duration) Option {
+	return func(cfg *Config) { cfg.BusyTimeout = d }
+}
+
+// WithRetryPolicy sets how writes are retried while the database is locked
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(cfg *Config) { cfg.Retry = policy }
+}
+
+// WithoutMigrations leaves the schema untouched
+func WithoutMigrations() Option {
+	return func(cfg *Config) { cfg.SkipMigrations = true }
+}
+
+// WithClock sets the function used to read the current time
+func WithClock(clock func() time.Time) Option {
+	return func(cfg *Config) { cfg.Clock = clock }
+}
+
+// WithLogger sets the logger receiving diagnostic messages
+func WithLogger(logger Logger) Option {
+	return func(cfg *Config) { cfg.Logger = logger }
+}
+
+// OpenWithConfig opens the database described by cfg. Writers start their
+// transactions with BEGIN IMMEDIATE so concurrent shells queue on the busy
+// timeout instead of failing when upgrading a read lock.
+func OpenWithConfig(ctx context.Context, cfg Config) (*DB, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("database path is required")
+	}
+	cfg = cfg.withDefaults()
+
+	sqlDB, err := sql.Open(driverName, cfg.dsn())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	db := &DB{
+		DB:     sqlDB,
+		retry:  cfg.Retry,
+		clock:  cfg.Clock,
+		logger: cfg.Logger,
+	}
+
+	// Connect eagerly so an invalid configuration is reported by Open
+	if err := db.withRetry(ctx, func() error { return sqlDB.PingContext(ctx) }); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	switch {
+	case cfg.ReadOnly:
+		if err := db.checkSchema(ctx); err != nil {
+			sqlDB.Close()
+			return nil, err
+		}
+	case !cfg.SkipMigrations:
+		// Bring the schema up to date, backing up existing databases first
+		if err := db.withRetry(ctx, func() error { return db.migrate(ctx, cfg.Path) }); err != nil {
+			sqlDB.Close()
+			return nil, err
+		}
+	}
+
+	// Builds with FTS5 keep the search index up to date with the entries
+	// any build added
+	if err := db.syncSearchIndex(ctx, !cfg.ReadOnly && !cfg.SkipMigrations); err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func (cfg Config) withDefaults() Config {
+	if cfg.Immutable {
+		cfg.ReadOnly = true
+	}
+	if cfg.JournalMode == "" {
+		cfg.JournalMode = DefaultJournalMode
+	}
+	if cfg.Synchronous == "" {
+		cfg.Synchronous = DefaultSynchronous
+	}
+	if cfg.CacheSize == 0 {
+		cfg.CacheSize = DefaultCacheSize
+	}
+	if cfg.BusyTimeout == 0 {
+		cfg.BusyTimeout = DefaultBusyTimeout
+	}
+	if cfg.Retry.MaxAttempts == 0 {
+		cfg.Retry = DefaultRetryPolicy
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = time.Now
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = discardLogger{}
+	}
+	return cfg
+}
+
+// dsn returns the go-sqlite3 data source name for the configuration.
+// Pragmas are passed as DSN parameters so every pooled connection gets
+// them, not just the first one.
+func (cfg Config) dsn() string {
+	path := cfg.Path
+	params := []string{
+		fmt.Sprintf("_busy_timeout=%d", cfg.BusyTimeout.Milliseconds()),
+		fmt.Sprintf("_cache_size=%d", cfg.CacheSize),
+	}
+
+	if cfg.ReadOnly {
+		// mode=ro is only honoured for URI filenames
+		path = fileURI(path)
+		params = append(params, "mode=ro")
+		if cfg.Immutable {
+			params = append(params, "immutable=1")
+		}
+	} else {
+		params = append(params,
+			"_journal_mode="+cfg.JournalMode,
+			"_synchronous="+cfg.Synchronous,
+			"_txlock=immediate",
+		)
+	}
+
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + strings.Join(params, "&")
+}
+
+// fileURI converts a file name to an SQLite "file:" URI
+func fileURI(path string) string {
+	if strings.HasPrefix(path, "file:") {
+		return path
+	}
+	return "file:" + strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(path)
+}
+
+// now returns the current time according to the configured clock
+func (db *DB) now() time.Time {
+	if db.clock == nil {
+		return time.Now()
+	}
+	return db.clock()
+}
+
+// logf writes a diagnostic message to the configured logger
+func (db *DB) logf(format string, args ...interface{}) {
+	if db.logger != nil {
+		db.logger.Printf(format, args...)
+	}
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Printf(string, ...interface{}) {}
+
+// withRetry runs fn, retrying it according to the retry policy while it
+// fails because the database is locked
+func (db *DB) withRetry(ctx context.Context, fn func() error) error {
+	policy := db.retry
+	if policy.MaxAttempts == 0 {
+		policy = DefaultRetryPolicy
+	}
+
+	backoff := policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isBusy(err) || attempt >= policy.MaxAttempts {
+			return err
+		}
+
+		delay := backoff
+		if delay > 0 {
+			delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+		}
+		db.logf("database is locked, retrying in %s (attempt %d of %d)", delay, attempt+1, policy.MaxAttempts)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		backoff *= 2
+		if backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// isBusy reports whether err was caused by another connection holding a lock
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+package histree
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// migrateNormalizeDirectories moves directory paths out of the history
+// table into the directories table, which stores each path once together
+// with its parent. Renaming a directory then updates a single row, and
+// subtree queries match against the much smaller directories table. The
+// history_entries view joins the path back in for reading.
+func migrateNormalizeDirectories(ctx context.Context, tx *sql.Tx) error {
+	queries := []string{
+		`CREATE TABLE IF NOT EXISTS directories (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			path TEXT NOT NULL UNIQUE,
+			parent_id INTEGER REFERENCES directories(id),
+			depth INTEGER NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_directories_parent ON directories(parent_id)`,
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to create directories table: %w", err)
+		}
+	}
+
+	if err := addColumn(ctx, tx, "history", "directory_id", "INTEGER REFERENCES directories(id)"); err != nil {
+		return err
+	}
+
+	legacy, err := columnExists(ctx, tx, "history", "directory")
+	if err != nil {
+		return err
+	}
+	if legacy {
+		if err := moveDirectoryColumn(ctx, tx); err != nil {
+			return err
+		}
+	}
+
+	queries = []string{
+		`CREATE INDEX IF NOT EXISTS idx_history_directory_timestamp ON history(directory_id, timestamp)`,
+		`CREATE VIEW IF NOT EXISTS history_entries AS
+			SELECT h.*, COALESCE(d.path, '') AS directory
+			FROM history h
+			LEFT JOIN directories d ON d.id = h.directory_id`,
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to create history_entries view: %w", err)
+		}
+	}
+	return nil
+}
+
+// moveDirectoryColumn fills history.directory_id from the directory column
+// and drops it
+func moveDirectoryColumn(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, "SELECT DISTINCT directory FROM history")
+	if err != nil {
+		return fmt.Errorf("failed to query directories: %w", err)
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		paths = append(paths, path)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error during row iteration: %w", err)
+	}
+	rows.Close()
+
+	for _, path := range paths {
+		if _, err := ensureDirectory(ctx, tx, path); err != nil {
+			return err
+		}
+	}
+
+	queries := []string{
+		`UPDATE history SET directory_id = (SELECT id FROM directories WHERE path = history.directory)`,
+		`DROP INDEX IF EXISTS idx_history_directory`,
+		`DROP INDEX IF EXISTS idx_history_timestamp_directory`,
+		`ALTER TABLE history DROP COLUMN directory`,
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to normalize directories: %w", err)
+		}
+	}
+	return nil
+}
+
+// ensureDirectory returns the ID of path in the directories table, adding
+// it and any missing ancestors
+func ensureDirectory(ctx context.Context, tx *sql.Tx, path string) (int64, error) {
+	var id int64
+	err := tx.QueryRowContext(ctx, "SELECT id FROM directories WHERE path = ?", path).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("failed to look up directory: %w", err)
+	}
+
+	var parentID sql.NullInt64
+	if parent := parentDir(path); parent != "" {
+		if parentID.Int64, err = ensureDirectory(ctx, tx, parent); err != nil {
+			return 0, err
+		}
+		parentID.Valid = true
+	}
+
+	result, err := tx.ExecContext(ctx,
+		"INSERT INTO directories (path, parent_id, depth) VALUES (?, ?, ?)",
+		path, parentID, pathDepth(path),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add directory: %w", err)
+	}
+	if id, err = result.LastInsertId(); err != nil {
+		return 0, fmt.Errorf("failed to add directory: %w", err)
+	}
+	return id, nil
+}
+
+// moveDirectories renames oldPath and its subdirectories to newPath in the
+// directories table. A directory whose new path is already known is merged
+// into the existing one. Renamed directories are journaled under the path
+// rewrite rewriteID, and so are the entries of merged ones, which no longer
+// have a directory of their own.
+func moveDirectories(ctx context.Context, tx *sql.Tx, oldPath, newPath string, rewriteID int64) error {
+	cond, args := subtreeCondition("path", oldPath)
+	rows, err := tx.QueryContext(ctx,
+		"SELECT id, path FROM directories WHERE "+cond+" ORDER BY depth, path",
+		args...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to query directories: %w", err)
+	}
+	defer rows.Close()
+
+	type directory struct {
+		id   int64
+		path string
+	}
+	var dirs []directory
+	for rows.Next() {
+		var dir directory
+		if err := rows.Scan(&dir.id, &dir.path); err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		dirs = append(dirs, dir)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error during row iteration: %w", err)
+	}
+	rows.Close()
+
+	// Move the directories out of the way first, so a new path inside
+	// oldPath never resolves to a directory that is itself being moved
+	for _, dir := range dirs {
+		_, err := tx.ExecContext(ctx,
+			"UPDATE directories SET path = ? WHERE id = ?",
+			"\x00"+strconv.FormatInt(dir.id, 10), dir.id,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to rename directory: %w", err)
+		}
+	}
+
+	// Parents come first, so each directory's new parent already exists
+	for _, dir := range dirs {
+		path := rewritePrefix(dir.path, oldPath, newPath)
+
+		var existing int64
+		err := tx.QueryRowContext(ctx, "SELECT id FROM directories WHERE path = ?", path).Scan(&existing)
+		switch {
+		case err == nil:
+			_, err := tx.ExecContext(ctx,
+				"INSERT INTO path_rewrite_entries (rewrite_id, history_id, old_directory) SELECT ?, id, ? FROM history WHERE directory_id = ?",
+				rewriteID, dir.path, dir.id,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to record path rewrite: %w", err)
+			}
+			queries := []string{
+				"UPDATE history SET directory_id = ? WHERE directory_id = ?",
+				"UPDATE directories SET parent_id = ? WHERE parent_id = ?",
+			}
+			for _, query := range queries {
+				if _, err := tx.ExecContext(ctx, query, existing, dir.id); err != nil {
+					return fmt.Errorf("failed to merge directory: %w", err)
+				}
+			}
+			if _, err := tx.ExecContext(ctx, "DELETE FROM directories WHERE id = ?", dir.id); err != nil {
+				return fmt.Errorf("failed to merge directory: %w", err)
+			}
+
+		case errors.Is(err, sql.ErrNoRows):
+			var parentID sql.NullInt64
+			if parent := parentDir(path); parent != "" {
+				if parentID.Int64, err = ensureDirectory(ctx, tx, parent); err != nil {
+					return err
+				}
+				parentID.Valid = true
+			}
+			_, err := tx.ExecContext(ctx,
+				"UPDATE directories SET path = ?, parent_id = ?, depth = ? WHERE id = ?",
+				path, parentID, pathDepth(path), dir.id,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to rename directory: %w", err)
+			}
+			_, err = tx.ExecContext(ctx,
+				"INSERT INTO path_rewrite_directories (rewrite_id, directory_id, old_path) VALUES (?, ?, ?)",
+				rewriteID, dir.id, dir.path,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to record path rewrite: %w", err)
+			}
+
+		default:
+			return fmt.Errorf("failed to look up directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// parentDir returns the parent of path, or "" for the root and for paths
+// without a separator
+func parentDir(path string) string {
+	i := strings.LastIndexByte(path, '/')
+	switch {
+	case path == "/" || i < 0:
+		return ""
+	case i == 0:
+		return "/"
+	}
+	return path[:i]
+}
+
+// pathDepth returns the number of ancestors of path
+func pathDepth(path string) int {
+	depth := 0
+	for parent := parentDir(path); parent != ""; parent = parentDir(parent) {
+		depth++
+	}
+	return depth
+}
@@ -0,0 +1,15 @@
+//go:build !(aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+
+package histree
+
+import "os"
+
+// fileID is not supported on this platform, so moves are only detected by
+// directory name
+func fileID(path string) (device, inode int64, ok bool) {
+	return 0, 0, false
+}
+
+func fileInfoID(info os.FileInfo) (device, inode int64, ok bool) {
+	return 0, 0, false
+}
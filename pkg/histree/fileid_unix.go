@@ -0,0 +1,26 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package histree
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns the device and inode numbers identifying the file at path
+func fileID(path string) (device, inode int64, ok bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, false
+	}
+	return fileInfoID(info)
+}
+
+// fileInfoID returns the device and inode numbers recorded in info
+func fileInfoID(info os.FileInfo) (device, inode int64, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int64(stat.Dev), int64(stat.Ino), true
+}
@@ -5,51 +5,272 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
-// WriteEntries writes history entries to the provided writer using the specified format
-func WriteEntries(entries []HistoryEntry, w io.Writer, format OutputFormat) error {
+// Formatter writes history entries in an output format. A Formatter is
+// used for a single output: Begin is called before the first entry and End
+// after the last, even if there are no entries, so formats can write a
+// header and footer.
+type Formatter interface {
+	// Begin writes anything preceding the entries to w
+	Begin(w io.Writer) error
+	// WriteEntry writes a single entry to w
+	WriteEntry(w io.Writer, entry HistoryEntry) error
+	// End writes anything following the entries to w
+	End(w io.Writer) error
+}
+
+// FormatterFactory returns a new Formatter for each output
+type FormatterFactory func() Formatter
+
+// FormatterFunc is a Formatter writing each entry with a function, and
+// nothing before or after the entries
+type FormatterFunc func(w io.Writer, entry HistoryEntry) error
+
+// Begin writes nothing
+func (f FormatterFunc) Begin(w io.Writer) error { return nil }
+
+// WriteEntry calls f(w, entry)
+func (f FormatterFunc) WriteEntry(w io.Writer, entry HistoryEntry) error { return f(w, entry) }
+
+// End writes nothing
+func (f FormatterFunc) End(w io.Writer) error { return nil }
+
+var (
+	formattersMu sync.RWMutex
+	formatters   = map[OutputFormat]FormatterFactory{
+		FormatJSON:      formatterFunc(writeJSON),
+		FormatJSONArray: func() Formatter { return &jsonArrayFormatter{} },
+		FormatSimple:    formatterFunc(writeSimple),
+		FormatVerbose:   formatterFunc(writeVerbose),
+		FormatNull:      formatterFunc(writeNull),
+		FormatZsh:       formatterFunc(writeZsh),
+		FormatBash:      formatterFunc(writeBash),
+		FormatFish:      formatterFunc(writeFish),
+		FormatCSV:       func() Formatter { return &csvFormatter{} },
+		FormatTSV:       func() Formatter { return tsvFormatter{} },
+		FormatHTML:      func() Formatter { return htmlFormatter{} },
+		FormatMarkdown:  func() Formatter { return markdownFormatter{} },
+	}
+)
+
+// formatterFunc returns a factory of a stateless FormatterFunc
+func formatterFunc(f FormatterFunc) FormatterFactory {
+	return func() Formatter { return f }
+}
+
+// RegisterFormat makes a format available to NewEntryWriter and
+// WriteEntries under name, replacing any format registered under the same
+// name, including built-in ones. It panics if factory is nil.
+func RegisterFormat(name OutputFormat, factory FormatterFactory) {
+	if factory == nil {
+		panic("histree: RegisterFormat factory is nil")
+	}
+
+	formattersMu.Lock()
+	defer formattersMu.Unlock()
+	formatters[name] = factory
+}
+
+// Formats returns the names of the available formats, sorted
+func Formats() []OutputFormat {
+	formattersMu.RLock()
+	defer formattersMu.RUnlock()
+
+	names := make([]OutputFormat, 0, len(formatters))
+	for name := range formatters {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// NewFormatter returns a new Formatter for the named format
+func NewFormatter(format OutputFormat) (Formatter, error) {
+	formattersMu.RLock()
+	factory := formatters[format]
+	formattersMu.RUnlock()
+
+	if factory == nil {
+		return nil, fmt.Errorf("unknown output format: %s", format)
+	}
+	return factory(), nil
+}
+
+// EntryWriter writes history entries one at a time in a given format.
+// Output is buffered; call Flush after the last entry.
+type EntryWriter struct {
+	w         *bufio.Writer
+	formatter Formatter
+	ended     bool
+}
+
+// NewEntryWriter returns an EntryWriter writing to w in the specified
+// format, which is either built in or registered with RegisterFormat
+func NewEntryWriter(w io.Writer, format OutputFormat) (*EntryWriter, error) {
+	formatter, err := NewFormatter(format)
+	if err != nil {
+		return nil, err
+	}
+
+	// The beginning is buffered, so nothing is written if it fails
 	bufW := bufio.NewWriterSize(w, 8192)
+	if err := formatter.Begin(bufW); err != nil {
+		return nil, err
+	}
+	return &EntryWriter{w: bufW, formatter: formatter}, nil
+}
 
-	for _, entry := range entries {
-		switch format {
-		case FormatJSON:
-			if err := json.NewEncoder(bufW).Encode(entry); err != nil {
-				return fmt.Errorf("failed to encode JSON: %w", err)
-			}
-		case FormatSimple:
-			if _, err := fmt.Fprintf(bufW, "%s\n", entry.Command); err != nil {
-				return fmt.Errorf("failed to write entry: %w", err)
-			}
-		case FormatVerbose:
-			command := entry.Command
-			if strings.HasPrefix(command, "{") && strings.HasSuffix(command, "}") {
-				command = fmt.Sprintf("%q", command)
-			}
-
-			exitStatus := ""
-			if entry.ExitCode != 0 {
-				exitStatus = fmt.Sprintf(" [%d]", entry.ExitCode)
-			}
-
-			// Convert UTC time to local timezone
-			localTime := entry.Timestamp.Local()
-
-			if _, err := fmt.Fprintf(bufW, "%s [%s]%s %s\n",
-				localTime.Format("2006-01-02T15:04:05"),
-				entry.Directory,
-				exitStatus,
-				command); err != nil {
-				return fmt.Errorf("failed to write entry: %w", err)
-			}
-		default:
-			return fmt.Errorf("unknown output format: %s", format)
+// Write writes a single entry
+func (ew *EntryWriter) Write(entry HistoryEntry) error {
+	return ew.formatter.WriteEntry(ew.w, entry)
+}
+
+// Flush ends the output and writes any buffered output to the underlying
+// writer
+func (ew *EntryWriter) Flush() error {
+	if !ew.ended {
+		ew.ended = true
+		if err := ew.formatter.End(ew.w); err != nil {
+			return err
 		}
 	}
-
-	if err := bufW.Flush(); err != nil {
+	if err := ew.w.Flush(); err != nil {
 		return fmt.Errorf("failed to flush buffer: %w", err)
 	}
 	return nil
 }
+
+// writeJSON writes entry as a JSON object on its own line
+func writeJSON(w io.Writer, entry HistoryEntry) error {
+	if err := json.NewEncoder(w).Encode(entry); err != nil {
+		return fmt.Errorf("failed to encode JSON: %w", err)
+	}
+	return nil
+}
+
+// jsonArrayFormatter writes all entries as a single JSON array
+type jsonArrayFormatter struct {
+	count int
+}
+
+func (f *jsonArrayFormatter) Begin(w io.Writer) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	return nil
+}
+
+func (f *jsonArrayFormatter) WriteEntry(w io.Writer, entry HistoryEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode JSON: %w", err)
+	}
+	separator := ",\n"
+	if f.count == 0 {
+		separator = "\n"
+	}
+	f.count++
+	if _, err := fmt.Fprintf(w, "%s%s", separator, data); err != nil {
+		return fmt.Errorf("failed to write entry: %w", err)
+	}
+	return nil
+}
+
+func (f *jsonArrayFormatter) End(w io.Writer) error {
+	end := "\n]\n"
+	if f.count == 0 {
+		end = "]\n"
+	}
+	if _, err := io.WriteString(w, end); err != nil {
+		return fmt.Errorf("failed to write footer: %w", err)
+	}
+	return nil
+}
+
+// writeSimple writes only the command of entry
+func writeSimple(w io.Writer, entry HistoryEntry) error {
+	if _, err := fmt.Fprintf(w, "%s\n", entry.Command); err != nil {
+		return fmt.Errorf("failed to write entry: %w", err)
+	}
+	return nil
+}
+
+// writeVerbose writes entry with its timestamp, directory, exit code and
+// duration
+func writeVerbose(w io.Writer, entry HistoryEntry) error {
+	command := entry.Command
+	if strings.HasPrefix(command, "{") && strings.HasSuffix(command, "}") {
+		command = fmt.Sprintf("%q", command)
+	}
+
+	exitStatus := ""
+	if entry.ExitCode != 0 && entry.ExitCode != ExitCodeUnknown {
+		exitStatus = fmt.Sprintf(" [%d]", entry.ExitCode)
+	}
+
+	duration := ""
+	if entry.Duration > 0 {
+		duration = fmt.Sprintf(" (%s)", FormatDuration(entry.Duration))
+	}
+
+	// Mark entries inherited from an ancestor with how far up it is
+	directory := entry.Directory
+	if entry.Distance != nil && *entry.Distance > 0 {
+		directory = fmt.Sprintf("%s ^%d", directory, *entry.Distance)
+	}
+
+	// Convert UTC time to local timezone
+	localTime := entry.Timestamp.Local()
+
+	if _, err := fmt.Fprintf(w, "%s [%s]%s%s %s\n",
+		localTime.Format("2006-01-02T15:04:05"),
+		directory,
+		exitStatus,
+		duration,
+		command); err != nil {
+		return fmt.Errorf("failed to write entry: %w", err)
+	}
+	return nil
+}
+
+// writeNull writes the command of entry terminated by a NUL byte
+func writeNull(w io.Writer, entry HistoryEntry) error {
+	if _, err := fmt.Fprintf(w, "%s\x00", entry.Command); err != nil {
+		return fmt.Errorf("failed to write entry: %w", err)
+	}
+	return nil
+}
+
+// FormatDuration renders a command duration compactly: milliseconds below
+// a second, tenths of a second below a minute, whole seconds above
+func FormatDuration(d time.Duration) string {
+	switch {
+	case d < time.Second:
+		return d.Round(time.Millisecond).String()
+	case d < time.Minute:
+		return d.Round(100 * time.Millisecond).String()
+	default:
+		return d.Round(time.Second).String()
+	}
+}
+
+// WriteEntries writes history entries to the provided writer using the specified format
+func WriteEntries(entries []HistoryEntry, w io.Writer, format OutputFormat) error {
+	ew, err := NewEntryWriter(w, format)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := ew.Write(entry); err != nil {
+			return err
+		}
+	}
+
+	return ew.Flush()
+}
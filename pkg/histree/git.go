@@ -0,0 +1,167 @@
+package histree
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Repository describes the git repository a command was run in
+type Repository struct {
+	// Root is the top-level directory of the working tree
+	Root string `json:"root"`
+	// Branch is the checked out branch, empty for a detached HEAD
+	Branch string `json:"branch,omitempty"`
+	// Commit is the full hash of HEAD, empty before the first commit
+	Commit string `json:"commit,omitempty"`
+	// Remote is the URL of the "origin" remote, or of the first remote
+	// if there is no origin
+	Remote string `json:"remote,omitempty"`
+}
+
+// ID returns the value identifying the repository in Query.Repository: the
+// remote URL, which is shared by every clone and worktree, or the root
+// directory for repositories without a remote
+func (r *Repository) ID() string {
+	if r.Remote != "" {
+		return r.Remote
+	}
+	return r.Root
+}
+
+// DetectRepository finds the git repository containing dir by looking for
+// .git in dir and its ancestors. It reads the repository files directly
+// instead of running git, so it is cheap enough to call for every command.
+// It returns nil if dir is not inside a repository.
+func DetectRepository(dir string) (*Repository, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		gitPath := filepath.Join(dir, ".git")
+		info, err := os.Stat(gitPath)
+		if err == nil {
+			return readRepository(dir, gitPath, info)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// readRepository reads the repository whose working tree is root. gitPath
+// is root/.git, either the git directory itself or, for worktrees and
+// submodules, a file pointing at it.
+func readRepository(root, gitPath string, info os.FileInfo) (*Repository, error) {
+	gitDir := gitPath
+	if !info.IsDir() {
+		data, err := os.ReadFile(gitPath)
+		if err != nil {
+			return nil, err
+		}
+		target := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(string(data)), "gitdir:"))
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(root, target)
+		}
+		gitDir = target
+	}
+
+	// Worktrees keep HEAD in their own git directory but share refs and
+	// configuration with the main repository
+	commonDir := gitDir
+	if data, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		commonDir = strings.TrimSpace(string(data))
+		if !filepath.IsAbs(commonDir) {
+			commonDir = filepath.Join(gitDir, commonDir)
+		}
+	}
+
+	repo := &Repository{Root: root}
+
+	head, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return nil, err
+	}
+	if ref := strings.TrimSpace(string(head)); strings.HasPrefix(ref, "ref:") {
+		ref = strings.TrimSpace(strings.TrimPrefix(ref, "ref:"))
+		repo.Branch = strings.TrimPrefix(ref, "refs/heads/")
+		repo.Commit = resolveRef(gitDir, commonDir, ref)
+	} else {
+		repo.Commit = ref
+	}
+
+	repo.Remote = readRemote(filepath.Join(commonDir, "config"))
+	return repo, nil
+}
+
+// resolveRef returns the commit ref points to, or "" if it does not exist yet
+func resolveRef(gitDir, commonDir, ref string) string {
+	for _, dir := range []string{gitDir, commonDir} {
+		if data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(ref))); err == nil {
+			return strings.TrimSpace(string(data))
+		}
+	}
+
+	f, err := os.Open(filepath.Join(commonDir, "packed-refs"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 && fields[1] == ref {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+// readRemote returns the URL of the origin remote, or of the first remote
+// defined in the git config file at path
+func readRemote(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	var (
+		section string
+		first   string
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			section = strings.Trim(line, "[]")
+			continue
+		}
+		if !strings.HasPrefix(section, "remote ") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(key) != "url" {
+			continue
+		}
+		url := strings.TrimSpace(value)
+		if section == `remote "origin"` {
+			return url
+		}
+		if first == "" {
+			first = url
+		}
+	}
+	return first
+}
@@ -0,0 +1,67 @@
+package histree
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// zshMeta is the byte zsh writes before bytes it escapes in its history
+const zshMeta = 0x83
+
+// fishEscaper escapes commands the way fish does in its history file
+var fishEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// writeZsh writes entry as a zsh extended history line. Newlines within
+// the command are escaped with a backslash.
+func writeZsh(w io.Writer, entry HistoryEntry) error {
+	elapsed := int64(entry.Duration / time.Second)
+	command := strings.ReplaceAll(metafy(entry.Command), "\n", "\\\n")
+	if _, err := fmt.Fprintf(w, ": %d:%d;%s\n", startTime(entry).Unix(), elapsed, command); err != nil {
+		return fmt.Errorf("failed to write entry: %w", err)
+	}
+	return nil
+}
+
+// writeBash writes entry as a bash history command preceded by its
+// #timestamp line
+func writeBash(w io.Writer, entry HistoryEntry) error {
+	if _, err := fmt.Fprintf(w, "#%d\n%s\n", startTime(entry).Unix(), entry.Command); err != nil {
+		return fmt.Errorf("failed to write entry: %w", err)
+	}
+	return nil
+}
+
+// writeFish writes entry as a fish history item
+func writeFish(w io.Writer, entry HistoryEntry) error {
+	command := fishEscaper.Replace(entry.Command)
+	if _, err := fmt.Fprintf(w, "- cmd: %s\n  when: %d\n", command, startTime(entry).Unix()); err != nil {
+		return fmt.Errorf("failed to write entry: %w", err)
+	}
+	return nil
+}
+
+// startTime returns when the command of entry started, which shell
+// histories record, falling back to when it finished
+func startTime(entry HistoryEntry) time.Time {
+	if entry.StartedAt != nil {
+		return *entry.StartedAt
+	}
+	return entry.Timestamp
+}
+
+// metafy escapes the bytes zsh reserves for its own use (NUL and 0x83 to
+// 0xa2) the way zsh does in its history file
+func metafy(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == 0 || (c >= zshMeta && c <= 0xa2) {
+			b.WriteByte(zshMeta)
+			b.WriteByte(c ^ 32)
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
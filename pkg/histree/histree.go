@@ -2,11 +2,10 @@
 package histree
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"time"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
 // Version information
@@ -14,51 +13,87 @@ const (
 	Version = "v0.3.5"
 )
 
-// OutputFormat defines how history entries are formatted when displayed
+// OutputFormat defines how history entries are formatted when displayed.
+// Besides the formats below, any format added with RegisterFormat can be used.
 type OutputFormat string
 
 const (
 	// FormatJSON outputs entries as JSON objects
 	FormatJSON OutputFormat = "json"
+	// FormatJSONArray outputs all entries as a single JSON array
+	FormatJSONArray OutputFormat = "json-array"
 	// FormatSimple outputs only the command
 	FormatSimple OutputFormat = "simple"
 	// FormatVerbose outputs entries with timestamp, directory and exit code
 	FormatVerbose OutputFormat = "verbose"
+	// FormatZsh outputs entries as a zsh extended history file
+	FormatZsh OutputFormat = "zsh"
+	// FormatBash outputs entries as a bash history file with #timestamp
+	// lines, as written when HISTTIMEFORMAT is set
+	FormatBash OutputFormat = "bash"
+	// FormatFish outputs entries as a fish history file
+	FormatFish OutputFormat = "fish"
+	// FormatCSV outputs entries as CSV with a header row
+	FormatCSV OutputFormat = "csv"
+	// FormatTSV outputs entries as tab-separated values with a header row.
+	// Tabs, newlines and backslashes in values are escaped with a backslash.
+	FormatTSV OutputFormat = "tsv"
+	// FormatNull outputs only the command, terminated by a NUL byte, so
+	// multiline commands can be read with fzf --read0 or xargs -0
+	FormatNull OutputFormat = "null"
+	// FormatHTML outputs entries as an HTML table
+	FormatHTML OutputFormat = "html"
+	// FormatMarkdown outputs entries as a Markdown table
+	FormatMarkdown OutputFormat = "markdown"
 )
 
+// ExitCodeUnknown is the exit code of entries imported from histories that
+// do not record it
+const ExitCodeUnknown = -1
+
 // HistoryEntry represents a shell command history entry
 type HistoryEntry struct {
-	Command   string    `json:"command"`
-	Directory string    `json:"directory"`
-	Timestamp time.Time `json:"timestamp"`
-	ExitCode  int       `json:"exit_code"`
-	Hostname  string    `json:"hostname,omitempty"`
-	ProcessID int       `json:"process_id,omitempty"` // The process ID of the shell that executed the command
+	Command   string     `json:"command"`
+	Directory string     `json:"directory"` // Empty if unknown, e.g. for imported entries
+	Timestamp time.Time  `json:"timestamp"` // The time the command finished
+	ExitCode  int        `json:"exit_code"`
+	Hostname  string     `json:"hostname,omitempty"`
+	ProcessID int        `json:"process_id,omitempty"` // The process ID of the shell that executed the command
+	SessionID string     `json:"session_id,omitempty"` // The shell session, see StartSession
+	StartedAt *time.Time `json:"started_at,omitempty"` // The time the command started, if known
+	// Duration is how long the command ran, if known. It is stored with
+	// millisecond precision and encoded in JSON as nanoseconds.
+	Duration time.Duration `json:"duration,omitempty"`
+	// Repository is the git repository the command was run in, if any
+	Repository *Repository `json:"repository,omitempty"`
+	// Distance is how many levels above the queried directory the command
+	// was run. It is only set by DirAncestors queries.
+	Distance *int `json:"distance,omitempty"`
 }
 
 // DB represents a histree database connection
 type DB struct {
 	*sql.DB
+	retry  RetryPolicy
+	clock  func() time.Time
+	logger Logger
+	// fts is set when SQLite has FTS5 and the database has the search index
+	fts bool
 }
 
-// OpenDB initializes and returns a new database connection
-func OpenDB(dbPath string) (*DB, error) {
-	db, err := sql.Open("sqlite3", dbPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
-	}
-
-	// Set PRAGMA for performance optimization
-	if err := setPragmas(db); err != nil {
-		return nil, err
-	}
+// OpenDB initializes and returns a new database connection. Options
+// override the defaults described on Config.
+func OpenDB(dbPath string, opts ...Option) (*DB, error) {
+	return OpenDBContext(context.Background(), dbPath, opts...)
+}
 
-	// Create tables and indexes within a transaction
-	if err := createSchema(db); err != nil {
-		return nil, err
+// OpenDBContext is like OpenDB but aborts schema migrations when ctx is done
+func OpenDBContext(ctx context.Context, dbPath string, opts ...Option) (*DB, error) {
+	cfg := Config{Path: dbPath}
+	for _, opt := range opts {
+		opt(&cfg)
 	}
-
-	return &DB{db}, nil
+	return OpenWithConfig(ctx, cfg)
 }
 
 // Close closes the database connection
@@ -66,185 +101,222 @@ func (db *DB) Close() error {
 	return db.DB.Close()
 }
 
-func setPragmas(db *sql.DB) error {
-	_, err := db.Exec(`
-		PRAGMA journal_mode = WAL;
-		PRAGMA synchronous = NORMAL;
-		PRAGMA temp_store = MEMORY;
-		PRAGMA cache_size = -2000;
-	`)
-	if err != nil {
-		return fmt.Errorf("failed to set pragmas: %w", err)
-	}
-	return nil
+// AddEntry adds a new command history entry to the database
+func (db *DB) AddEntry(entry *HistoryEntry) error {
+	return db.AddEntryContext(context.Background(), entry)
 }
 
-func createSchema(db *sql.DB) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
-	}
-	defer tx.Rollback()
+// AddEntryContext is like AddEntry but aborts when ctx is done.
+// Entries without a timestamp are stamped with the configured clock.
+func (db *DB) AddEntryContext(ctx context.Context, entry *HistoryEntry) error {
+	db.prepareEntry(entry)
 
-	// Create table with process information
-	if err := createTable(tx); err != nil {
-		return err
-	}
-
-	// Create indexes
-	if err := createIndexes(tx); err != nil {
-		return err
-	}
+	err := db.withRetry(ctx, func() error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
 
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+		if err := insertEntry(ctx, tx, entry); err != nil {
+			return err
+		}
+		if db.fts {
+			if err := indexEntries(ctx, tx); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to insert entry: %w", err)
 	}
-
 	return nil
 }
 
-func createTable(tx *sql.Tx) error {
-	_, err := tx.Exec(`
-		CREATE TABLE IF NOT EXISTS history (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			command TEXT NOT NULL,
-			directory TEXT NOT NULL,
-			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
-			exit_code INTEGER NOT NULL,
-			hostname TEXT NOT NULL,
-			process_id INTEGER NOT NULL
-		)
-	`)
-	if err != nil {
-		return fmt.Errorf("failed to create table: %w", err)
-	}
-	return nil
+// DefaultBatchSize is the number of entries AddEntries inserts per
+// transaction when AddEntriesOptions.BatchSize is zero
+const DefaultBatchSize = 1000
+
+// AddEntriesOptions control how AddEntries inserts entries
+type AddEntriesOptions struct {
+	// BatchSize is the number of entries inserted per transaction
+	BatchSize int
+	// SkipDuplicates skips entries already recorded before the call with
+	// the same command, timestamp, hostname and process ID, so importing
+	// the same history twice adds nothing the second time
+	SkipDuplicates bool
 }
 
-func createIndexes(tx *sql.Tx) error {
-	queries := []string{
-		`CREATE INDEX IF NOT EXISTS idx_history_directory ON history(directory)`,
-		`CREATE INDEX IF NOT EXISTS idx_history_timestamp_directory ON history(timestamp, directory)`,
+// AddEntries adds many entries in batches, one transaction per batch, and
+// returns how many were added. Entries are stamped like AddEntryContext.
+// Batches committed before an error are kept.
+func (db *DB) AddEntries(ctx context.Context, entries []HistoryEntry, opts AddEntriesOptions) (int, error) {
+	size := opts.BatchSize
+	if size <= 0 {
+		size = DefaultBatchSize
 	}
 
-	for _, query := range queries {
-		if _, err := tx.Exec(query); err != nil {
-			return fmt.Errorf("failed to create index: %w", err)
+	// Only compare against entries that existed before, so repeated
+	// commands within entries are all kept
+	var lastID int64
+	if opts.SkipDuplicates {
+		if err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM history").Scan(&lastID); err != nil {
+			return 0, fmt.Errorf("failed to query entries: %w", err)
 		}
 	}
-	return nil
-}
 
-// AddEntry adds a new command history entry to the database
-func (db *DB) AddEntry(entry *HistoryEntry) error {
-	_, err := db.Exec(
-		"INSERT INTO history (command, directory, timestamp, exit_code, hostname, process_id) VALUES (?, ?, ?, ?, ?, ?)",
-		entry.Command,
-		entry.Directory,
-		entry.Timestamp,
-		entry.ExitCode,
-		entry.Hostname,
-		entry.ProcessID,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to insert entry: %w", err)
+	added := 0
+	for start := 0; start < len(entries); start += size {
+		end := start + size
+		if end > len(entries) {
+			end = len(entries)
+		}
+		batch := entries[start:end]
+		for i := range batch {
+			db.prepareEntry(&batch[i])
+		}
+
+		var n int
+		err := db.withRetry(ctx, func() error {
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+
+			n = 0
+			for i := range batch {
+				if opts.SkipDuplicates {
+					exists, err := entryExists(ctx, tx, &batch[i], lastID)
+					if err != nil {
+						return err
+					}
+					if exists {
+						continue
+					}
+				}
+				if err := insertEntry(ctx, tx, &batch[i]); err != nil {
+					return err
+				}
+				n++
+			}
+			if db.fts {
+				if err := indexEntries(ctx, tx); err != nil {
+					return err
+				}
+			}
+			return tx.Commit()
+		})
+		if err != nil {
+			return added, fmt.Errorf("failed to insert entries: %w", err)
+		}
+		added += n
 	}
-	return nil
+	return added, nil
 }
 
-// UpdatePaths updates directory paths in history entries from oldPath to newPath
-func (db *DB) UpdatePaths(oldPath, newPath string) (int64, error) {
-	tx, err := db.Begin()
-	if err != nil {
-		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+// prepareEntry stamps entry with the current time if it has no timestamp
+// and derives whichever of its start time and duration is missing
+func (db *DB) prepareEntry(entry *HistoryEntry) {
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = db.now().UTC()
 	}
-	defer tx.Rollback()
 
-	// Update entries where directory exactly matches oldPath
-	exactResult, err := tx.Exec(
-		"UPDATE history SET directory = ? WHERE directory = ?",
-		newPath, oldPath,
-	)
-	if err != nil {
-		return 0, fmt.Errorf("failed to update exact matches: %w", err)
+	if entry.StartedAt != nil && entry.Duration == 0 {
+		if d := entry.Timestamp.Sub(*entry.StartedAt); d > 0 {
+			entry.Duration = d
+		}
 	}
-
-	// Update entries where directory is a subdirectory of oldPath
-	subResult, err := tx.Exec(
-		"UPDATE history SET directory = REPLACE(directory, ?, ?) WHERE directory LIKE ? || '/%'",
-		oldPath, newPath, oldPath,
-	)
-	if err != nil {
-		return 0, fmt.Errorf("failed to update subdirectory matches: %w", err)
+	if entry.StartedAt == nil && entry.Duration > 0 {
+		startedAt := entry.Timestamp.Add(-entry.Duration)
+		entry.StartedAt = &startedAt
 	}
-
-	if err := tx.Commit(); err != nil {
-		return 0, fmt.Errorf("failed to commit transaction: %w", err)
-	}
-
-	// Get total number of rows affected by both updates
-	exactCount, _ := exactResult.RowsAffected()
-	subCount, _ := subResult.RowsAffected()
-	return exactCount + subCount, nil
 }
 
-// GetEntries retrieves command history entries from the database
-func (db *DB) GetEntries(limit int, currentDir string) ([]HistoryEntry, error) {
-	entries := make([]HistoryEntry, 0, limit)
-
-	// Modified query to get the last N entries in chronological order
-	query := `
-		WITH recent_entries AS (
-			SELECT command, directory, timestamp, exit_code, hostname, process_id
-			FROM history 
-			WHERE directory = ? OR directory LIKE ? || '/%'
-			ORDER BY timestamp DESC
-			LIMIT ?
-		)
-		SELECT * FROM recent_entries ORDER BY timestamp ASC
-	`
-
-	tx, err := db.Begin()
-	if err != nil {
-		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+// insertEntry inserts a prepared entry within tx
+func insertEntry(ctx context.Context, tx *sql.Tx, entry *HistoryEntry) error {
+	var (
+		startedAt  sql.NullTime
+		durationMS sql.NullInt64
+	)
+	if entry.StartedAt != nil {
+		startedAt = sql.NullTime{Time: entry.StartedAt.UTC(), Valid: true}
+		durationMS = sql.NullInt64{Int64: entry.Duration.Milliseconds(), Valid: true}
 	}
-	defer tx.Rollback()
 
-	_, err = tx.Exec("PRAGMA page_size = 4096")
-	if err != nil {
-		return nil, fmt.Errorf("failed to set page size: %w", err)
+	// Remember which directory this was so Reconcile can find it after a move
+	var device, inode sql.NullInt64
+	if dev, ino, ok := fileID(entry.Directory); ok {
+		device = sql.NullInt64{Int64: dev, Valid: true}
+		inode = sql.NullInt64{Int64: ino, Valid: true}
 	}
 
-	// Pass currentDir twice for the two placeholders (exact match and LIKE pattern)
-	rows, err := tx.Query(query, currentDir, currentDir, limit)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query entries: %w", err)
+	var repo Repository
+	if entry.Repository != nil {
+		repo = *entry.Repository
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var entry HistoryEntry
-		err := rows.Scan(
-			&entry.Command,
-			&entry.Directory,
-			&entry.Timestamp,
-			&entry.ExitCode,
-			&entry.Hostname,
-			&entry.ProcessID,
-		)
+
+	// Entries with an unknown directory refer to none
+	var dirID sql.NullInt64
+	if entry.Directory != "" {
+		id, err := ensureDirectory(ctx, tx, entry.Directory)
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan row: %w", err)
+			return err
 		}
-		entries = append(entries, entry)
+		dirID = sql.NullInt64{Int64: id, Valid: true}
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error during row iteration: %w", err)
-	}
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO history (command, directory_id, timestamp, exit_code, hostname, process_id, session_id, started_at, duration_ms, dir_device, dir_inode, git_root, git_branch, git_commit, git_remote) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		entry.Command,
+		dirID,
+		entry.Timestamp.UTC(),
+		entry.ExitCode,
+		entry.Hostname,
+		entry.ProcessID,
+		nullString(entry.SessionID),
+		startedAt,
+		durationMS,
+		device,
+		inode,
+		nullString(repo.Root),
+		nullString(repo.Branch),
+		nullString(repo.Commit),
+		nullString(repo.Remote),
+	)
+	return err
+}
 
-	if err := tx.Commit(); err != nil {
-		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+// entryExists reports whether an entry up to lastID has the same command,
+// timestamp, hostname and process ID as entry
+func entryExists(ctx context.Context, tx *sql.Tx, entry *HistoryEntry, lastID int64) (bool, error) {
+	var exists bool
+	err := tx.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM history WHERE hostname = ? AND process_id = ? AND timestamp = ? AND command = ? AND id <= ?)",
+		entry.Hostname, entry.ProcessID, entry.Timestamp.UTC(), entry.Command, lastID,
+	).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up entry: %w", err)
 	}
+	return exists, nil
+}
+
+// nullString maps an empty string to SQL NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// GetEntries retrieves the most recent limit entries recorded in currentDir
+// or its subdirectories, in chronological order. It is a shorthand for Find.
+func (db *DB) GetEntries(limit int, currentDir string) ([]HistoryEntry, error) {
+	return db.GetEntriesContext(context.Background(), limit, currentDir)
+}
 
-	return entries, nil
+// GetEntriesContext is like GetEntries but aborts when ctx is done
+func (db *DB) GetEntriesContext(ctx context.Context, limit int, currentDir string) ([]HistoryEntry, error) {
+	return db.Find(ctx, Query{
+		Directory: currentDir,
+		Limit:     limit,
+	})
 }
@@ -0,0 +1,368 @@
+package histree
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// migration describes a single schema change. Migrations are applied in
+// order and the version of the last applied migration is stored in
+// PRAGMA user_version.
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, tx *sql.Tx) error
+}
+
+// migrations lists every schema change in the order it must be applied.
+// Entries must never be reordered or removed once released; add new
+// migrations to the end of the list.
+var migrations = []migration{
+	{version: 1, name: "create history table", up: migrateCreateHistory},
+	{version: 2, name: "convert session_label to hostname and process_id", up: migrateSessionLabel},
+	{version: 3, name: "create full-text search index", up: migrateCreateFTS},
+	{version: 4, name: "create sessions table", up: migrateCreateSessions},
+	{version: 5, name: "add command start time and duration", up: migrateAddDuration},
+	{version: 6, name: "create path rewrite journal", up: migrateCreatePathRewrites},
+	{version: 7, name: "create directory aliases table", up: migrateCreateAliases},
+	{version: 8, name: "add directory device and inode", up: migrateAddFileID},
+	{version: 9, name: "normalize directories", up: migrateNormalizeDirectories},
+	{version: 10, name: "add git repository context", up: migrateAddRepository},
+	{version: 11, name: "index command sequences", up: migrateIndexSequences},
+	{version: 12, name: "index timestamps", up: migrateIndexTimestamps},
+	{version: 13, name: "index commands", up: migrateIndexCommands},
+}
+
+// Errors returned when opening a database read-only
+var (
+	// ErrSchemaMissing means the database has no histree tables
+	ErrSchemaMissing = errors.New("database has no histree schema")
+	// ErrSchemaOutdated means the database needs migrations that cannot be
+	// applied without write access
+	ErrSchemaOutdated = errors.New("database schema is outdated")
+)
+
+// latestVersion returns the schema version this package migrates databases to
+func latestVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func (db *DB) migrate(ctx context.Context, dbPath string) error {
+	current, err := schemaVersion(ctx, db.DB)
+	if err != nil {
+		return err
+	}
+	latest := latestVersion()
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", current, latest)
+	}
+	if current == latest {
+		return nil
+	}
+
+	// Hold the write lock from the backup to the last migration, so
+	// processes opening an outdated database at the same time wait for the
+	// first one instead of backing it up and migrating it again
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRowContext(ctx, "PRAGMA user_version").Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if current >= latest {
+		return nil
+	}
+
+	// Take a backup before touching a database that already holds history.
+	// It is read through another connection, which the write lock does not
+	// block.
+	var exists bool
+	err = tx.QueryRowContext(ctx,
+		"SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'history'",
+	).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to inspect schema: %w", err)
+	}
+	if exists {
+		backupPath, err := db.backup(ctx, dbPath)
+		if err != nil {
+			return err
+		}
+		if backupPath != "" {
+			db.logf("backed up database to %s", backupPath)
+		}
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(ctx, tx, m); err != nil {
+			return err
+		}
+		db.logf("applied migration %d (%s)", m.version, m.name)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// checkSchema verifies, without writing, that the schema is current
+func (db *DB) checkSchema(ctx context.Context) error {
+	current, err := schemaVersion(ctx, db.DB)
+	if err != nil {
+		return err
+	}
+
+	latest := latestVersion()
+	switch {
+	case current > latest:
+		return fmt.Errorf("database schema version %d is newer than supported version %d", current, latest)
+	case current == latest:
+		return nil
+	case current == 0:
+		exists, err := tableExists(ctx, db.DB, "history")
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrSchemaMissing
+		}
+	}
+	return fmt.Errorf("%w: version %d, need %d", ErrSchemaOutdated, current, latest)
+}
+
+func applyMigration(ctx context.Context, tx *sql.Tx, m migration) error {
+	if err := m.up(ctx, tx); err != nil {
+		return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+	}
+
+	// PRAGMA statements do not accept bound parameters
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", m.version)); err != nil {
+		return fmt.Errorf("failed to set schema version: %w", err)
+	}
+	return nil
+}
+
+func schemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var version int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+func tableExists(ctx context.Context, db *sql.DB, name string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?",
+		name,
+	).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect schema: %w", err)
+	}
+	return count > 0, nil
+}
+
+func columnExists(ctx context.Context, tx *sql.Tx, table, column string) (bool, error) {
+	var count int
+	err := tx.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?",
+		table, column,
+	).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	return count > 0, nil
+}
+
+// addColumn adds a column to table unless it already exists, which keeps
+// migrations safe to re-run like the IF NOT EXISTS clauses elsewhere
+func addColumn(ctx context.Context, tx *sql.Tx, table, column, definition string) error {
+	exists, err := columnExists(ctx, tx, table, column)
+	if err != nil || exists {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// backup writes a consistent copy of the database next to dbPath and
+// returns its path. In-memory databases are not backed up, and neither are
+// databases already backed up under the same name within the second.
+func (db *DB) backup(ctx context.Context, dbPath string) (string, error) {
+	if isMemoryPath(dbPath) {
+		return "", nil
+	}
+
+	// Strip URI syntax to get the file name
+	dbPath = strings.TrimPrefix(dbPath, "file:")
+	if i := strings.IndexByte(dbPath, '?'); i >= 0 {
+		dbPath = dbPath[:i]
+	}
+
+	backupPath := fmt.Sprintf("%s.bak.%s", dbPath, db.now().Format("20060102_150405"))
+	if _, err := os.Stat(backupPath); err == nil {
+		db.logf("skipped backup, %s already exists", backupPath)
+		return "", nil
+	}
+
+	if _, err := db.ExecContext(ctx, "VACUUM INTO ?", backupPath); err != nil {
+		// Another process may have created the file since it was checked
+		if _, statErr := os.Stat(backupPath); statErr == nil {
+			db.logf("skipped backup, %s already exists", backupPath)
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to back up database to %s: %w", backupPath, err)
+	}
+	return backupPath, nil
+}
+
+func isMemoryPath(dbPath string) bool {
+	return dbPath == "" || dbPath == ":memory:" || strings.Contains(dbPath, "mode=memory") ||
+		strings.HasPrefix(dbPath, "file::memory:")
+}
+
+func migrateCreateHistory(ctx context.Context, tx *sql.Tx) error {
+	if err := createTable(ctx, tx); err != nil {
+		return err
+	}
+	return createIndexes(ctx, tx)
+}
+
+func createTable(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			command TEXT NOT NULL,
+			directory TEXT NOT NULL,
+			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+			exit_code INTEGER NOT NULL,
+			hostname TEXT NOT NULL,
+			process_id INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create table: %w", err)
+	}
+	return nil
+}
+
+func createIndexes(ctx context.Context, tx *sql.Tx) error {
+	queries := []string{
+		`CREATE INDEX IF NOT EXISTS idx_history_directory ON history(directory)`,
+		`CREATE INDEX IF NOT EXISTS idx_history_timestamp_directory ON history(timestamp, directory)`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to create index: %w", err)
+		}
+	}
+	return nil
+}
+
+// migrateSessionLabel converts v0.1 databases, which stored "hostname@pid"
+// in a session_label column, to separate hostname and process_id columns.
+func migrateSessionLabel(ctx context.Context, tx *sql.Tx) error {
+	legacy, err := columnExists(ctx, tx, "history", "session_label")
+	if err != nil {
+		return err
+	}
+	if !legacy {
+		return nil
+	}
+
+	queries := []string{
+		`CREATE TABLE history_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			command TEXT NOT NULL,
+			directory TEXT NOT NULL,
+			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+			exit_code INTEGER NOT NULL,
+			hostname TEXT NOT NULL,
+			process_id INTEGER NOT NULL
+		)`,
+		`INSERT INTO history_new (id, command, directory, timestamp, exit_code, hostname, process_id)
+		SELECT
+			id,
+			command,
+			directory,
+			timestamp,
+			exit_code,
+			COALESCE(
+				CASE
+					WHEN instr(session_label, '@') > 0
+					THEN substr(session_label, 1, instr(session_label, '@') - 1)
+				END,
+				'unknown'
+			),
+			COALESCE(
+				CASE
+					WHEN instr(session_label, '@') > 0
+					THEN CAST(substr(session_label, instr(session_label, '@') + 1) AS INTEGER)
+				END,
+				0
+			)
+		FROM history`,
+		`DROP TABLE history`,
+		`ALTER TABLE history_new RENAME TO history`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to convert legacy history table: %w", err)
+		}
+	}
+	return createIndexes(ctx, tx)
+}
+
+func migrateAddDuration(ctx context.Context, tx *sql.Tx) error {
+	if err := addColumn(ctx, tx, "history", "started_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := addColumn(ctx, tx, "history", "duration_ms", "INTEGER"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_history_duration ON history(duration_ms)`); err != nil {
+		return fmt.Errorf("failed to create index: %w", err)
+	}
+	return nil
+}
+
+func migrateAddFileID(ctx context.Context, tx *sql.Tx) error {
+	if err := addColumn(ctx, tx, "history", "dir_device", "INTEGER"); err != nil {
+		return err
+	}
+	return addColumn(ctx, tx, "history", "dir_inode", "INTEGER")
+}
+
+func migrateAddRepository(ctx context.Context, tx *sql.Tx) error {
+	for _, column := range []string{"git_root", "git_branch", "git_commit", "git_remote"} {
+		if err := addColumn(ctx, tx, "history", column, "TEXT"); err != nil {
+			return err
+		}
+	}
+
+	queries := []string{
+		`CREATE INDEX IF NOT EXISTS idx_history_git_remote ON history(git_remote, timestamp)`,
+		`CREATE INDEX IF NOT EXISTS idx_history_git_root ON history(git_root, timestamp)`,
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to create index: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,453 @@
+package histree
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrPathRewriteNotFound is returned when a path rewrite ID does not exist
+var ErrPathRewriteNotFound = errors.New("path rewrite not found")
+
+// ErrPathRewriteUndone is returned when undoing a path rewrite twice
+var ErrPathRewriteUndone = errors.New("path rewrite has already been undone")
+
+// ErrNothingToUndo is returned when every entry of a path rewrite has moved
+// again since, leaving the rewrite to be undone later
+var ErrNothingToUndo = errors.New("no entries of the path rewrite are left to undo")
+
+// PathChange describes how the entries recorded in one directory are rewritten
+type PathChange struct {
+	OldDirectory string `json:"old_directory"`
+	NewDirectory string `json:"new_directory"`
+	Entries      int64  `json:"entries"`
+}
+
+// PathRewrite reports the effect of rewriting OldPath to NewPath. Applied
+// rewrites are recorded in a journal under ID so they can be undone with
+// UndoPathRewrite; dry runs have a zero ID.
+type PathRewrite struct {
+	ID      int64        `json:"id,omitempty"`
+	OldPath string       `json:"old_path"`
+	NewPath string       `json:"new_path"`
+	Changes []PathChange `json:"changes"`
+}
+
+// Entries returns the total number of entries rewritten
+func (r *PathRewrite) Entries() int64 {
+	var total int64
+	for _, change := range r.Changes {
+		total += change.Entries
+	}
+	return total
+}
+
+// PathRewriteOptions controls RewritePaths
+type PathRewriteOptions struct {
+	// DryRun reports the changes without applying them
+	DryRun bool
+}
+
+// UpdatePaths updates directory paths in history entries from oldPath to newPath
+func (db *DB) UpdatePaths(oldPath, newPath string) (int64, error) {
+	return db.UpdatePathsContext(context.Background(), oldPath, newPath)
+}
+
+// UpdatePathsContext is like UpdatePaths but aborts and rolls back when ctx is done
+func (db *DB) UpdatePathsContext(ctx context.Context, oldPath, newPath string) (int64, error) {
+	report, err := db.RewritePaths(ctx, oldPath, newPath, PathRewriteOptions{})
+	if err != nil {
+		return 0, err
+	}
+	return report.Entries(), nil
+}
+
+// RewritePaths moves the history of oldPath and its subdirectories to
+// newPath. Only the leading oldPath is replaced, and characters such as
+// '%', '_' or '*' in paths are matched literally. The report lists every
+// affected directory with its new path and number of entries.
+func (db *DB) RewritePaths(ctx context.Context, oldPath, newPath string, opts PathRewriteOptions) (*PathRewrite, error) {
+	oldPath = trimTrailingSlash(oldPath)
+	newPath = trimTrailingSlash(newPath)
+	if oldPath == "" || newPath == "" {
+		return nil, errors.New("both old and new paths are required")
+	}
+
+	var report *PathRewrite
+	err := db.withRetry(ctx, func() error {
+		var err error
+		report, err = db.rewritePaths(ctx, oldPath, newPath, opts)
+		return err
+	})
+	return report, err
+}
+
+func (db *DB) rewritePaths(ctx context.Context, oldPath, newPath string, opts PathRewriteOptions) (*PathRewrite, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	cond, args, err := directoryCondition("directory_id", []string{oldPath}, DirSubtree)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		"SELECT directory, COUNT(*) FROM history_entries WHERE "+cond+" GROUP BY directory ORDER BY directory",
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find affected directories: %w", err)
+	}
+	defer rows.Close()
+
+	report := &PathRewrite{OldPath: oldPath, NewPath: newPath, Changes: []PathChange{}}
+	for rows.Next() {
+		var change PathChange
+		if err := rows.Scan(&change.OldDirectory, &change.Entries); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		change.NewDirectory = rewritePrefix(change.OldDirectory, oldPath, newPath)
+		report.Changes = append(report.Changes, change)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during row iteration: %w", err)
+	}
+	rows.Close()
+
+	if opts.DryRun || len(report.Changes) == 0 {
+		return report, nil
+	}
+
+	// The last entry ID tells the entries rewritten apart from those
+	// recorded in the renamed directories afterwards
+	result, err := tx.ExecContext(ctx,
+		"INSERT INTO path_rewrites (old_path, new_path, created_at, last_history_id) SELECT ?, ?, ?, COALESCE(MAX(id), 0) FROM history",
+		oldPath, newPath, db.now().UTC(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record path rewrite: %w", err)
+	}
+	if report.ID, err = result.LastInsertId(); err != nil {
+		return nil, fmt.Errorf("failed to record path rewrite: %w", err)
+	}
+
+	// Entries refer to directories by ID, so renaming the directories moves
+	// their entries along
+	if err := moveDirectories(ctx, tx, oldPath, newPath, report.ID); err != nil {
+		return nil, err
+	}
+	if err := moveRepositoryRoots(ctx, tx, oldPath, newPath, "1 = 1"); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return report, nil
+}
+
+// UndoPathRewrite moves the entries changed by the path rewrite with the
+// given ID back to their original directories. Entries whose directory has
+// changed again since the rewrite are left alone, and ErrNothingToUndo is
+// returned if that leaves none. The report lists the restored directories,
+// with NewDirectory holding the original path.
+func (db *DB) UndoPathRewrite(ctx context.Context, id int64) (*PathRewrite, error) {
+	var report *PathRewrite
+	err := db.withRetry(ctx, func() error {
+		var err error
+		report, err = db.undoPathRewrite(ctx, id)
+		return err
+	})
+	return report, err
+}
+
+func (db *DB) undoPathRewrite(ctx context.Context, id int64) (*PathRewrite, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var (
+		oldPath, newPath string
+		lastID           int64
+		undoneAt         sql.NullTime
+	)
+	err = tx.QueryRowContext(ctx,
+		"SELECT old_path, new_path, last_history_id, undone_at FROM path_rewrites WHERE id = ?", id,
+	).Scan(&oldPath, &newPath, &lastID, &undoneAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %d", ErrPathRewriteNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get path rewrite: %w", err)
+	}
+	if undoneAt.Valid {
+		return nil, fmt.Errorf("%w: %d", ErrPathRewriteUndone, id)
+	}
+
+	// The entries recorded in a renamed directory by the time of the
+	// rewrite, except those a later rewrite merged into it
+	const rewritten = `h.id <= ? AND h.id NOT IN (SELECT history_id FROM path_rewrite_entries WHERE rewrite_id > ?)`
+
+	report := &PathRewrite{ID: id, OldPath: newPath, NewPath: oldPath, Changes: []PathChange{}}
+
+	// Directories renamed by the rewrite still have the new path unless
+	// they have been moved again since
+	rows, err := tx.QueryContext(ctx, `
+		SELECT j.directory_id, d.path, j.old_path, COUNT(*)
+		FROM path_rewrite_directories j
+		JOIN directories d ON d.id = j.directory_id
+		JOIN history h ON h.directory_id = j.directory_id
+		WHERE j.rewrite_id = ? AND `+rewritten+`
+		GROUP BY j.directory_id
+		ORDER BY j.old_path`,
+		id, lastID, id,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find rewritten directories: %w", err)
+	}
+	defer rows.Close()
+
+	var moved []int64
+	for rows.Next() {
+		var (
+			dirID  int64
+			change PathChange
+		)
+		if err := rows.Scan(&dirID, &change.OldDirectory, &change.NewDirectory, &change.Entries); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if change.OldDirectory != rewritePrefix(change.NewDirectory, oldPath, newPath) {
+			continue
+		}
+		moved = append(moved, dirID)
+		report.Changes = append(report.Changes, change)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during row iteration: %w", err)
+	}
+	rows.Close()
+
+	// Move all entries in one statement, since a directory may be restored
+	// to the path another one was renamed to
+	if len(moved) > 0 {
+		var restored, targets strings.Builder
+		restored.WriteString("directory_id IN (")
+		for i, dirID := range moved {
+			target, err := ensureDirectory(ctx, tx, report.Changes[i].NewDirectory)
+			if err != nil {
+				return nil, err
+			}
+			if i > 0 {
+				restored.WriteString(", ")
+			}
+			fmt.Fprintf(&restored, "%d", dirID)
+			fmt.Fprintf(&targets, " WHEN %d THEN %d", dirID, target)
+		}
+		restored.WriteString(") AND " + rewritten)
+
+		if err := moveRepositoryRoots(ctx, tx, newPath, oldPath, restored.String(), lastID, id); err != nil {
+			return nil, err
+		}
+		_, err := tx.ExecContext(ctx,
+			"UPDATE history AS h SET directory_id = CASE directory_id"+targets.String()+" END WHERE "+restored.String(),
+			lastID, id,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore paths: %w", err)
+		}
+	}
+
+	// Entries of directories merged into existing ones are recorded one by
+	// one. They are restored while still in the directory the rewrite moved
+	// them to.
+	const unchanged = `
+		FROM path_rewrite_entries e
+		JOIN history_entries h ON h.id = e.history_id
+		WHERE e.rewrite_id = ?
+		AND h.directory = rewrite_prefix(e.old_directory, ?, ?)`
+
+	rows, err = tx.QueryContext(ctx,
+		"SELECT h.directory, e.old_directory, COUNT(*)"+unchanged+" GROUP BY e.old_directory ORDER BY e.old_directory",
+		id, oldPath, newPath,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find rewritten entries: %w", err)
+	}
+	defer rows.Close()
+
+	var merged []PathChange
+	for rows.Next() {
+		var change PathChange
+		if err := rows.Scan(&change.OldDirectory, &change.NewDirectory, &change.Entries); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		merged = append(merged, change)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during row iteration: %w", err)
+	}
+	rows.Close()
+
+	for _, change := range merged {
+		restored := "id IN (SELECT h.id" + unchanged + " AND e.old_directory = ?)"
+		restoredArgs := []interface{}{id, oldPath, newPath, change.NewDirectory}
+		if err := moveRepositoryRoots(ctx, tx, newPath, oldPath, restored, restoredArgs...); err != nil {
+			return nil, err
+		}
+		if err := restoreEntries(ctx, tx, change.NewDirectory, restored, restoredArgs...); err != nil {
+			return nil, err
+		}
+	}
+	report.Changes = append(report.Changes, merged...)
+	if len(report.Changes) == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrNothingToUndo, id)
+	}
+	sort.Slice(report.Changes, func(i, j int) bool {
+		return report.Changes[i].NewDirectory < report.Changes[j].NewDirectory
+	})
+
+	if _, err := tx.ExecContext(ctx, "UPDATE path_rewrites SET undone_at = ? WHERE id = ?", db.now().UTC(), id); err != nil {
+		return nil, fmt.Errorf("failed to record undo: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return report, nil
+}
+
+func migrateCreatePathRewrites(ctx context.Context, tx *sql.Tx) error {
+	queries := []string{
+		`CREATE TABLE IF NOT EXISTS path_rewrites (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			old_path TEXT NOT NULL,
+			new_path TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			undone_at DATETIME,
+			last_history_id INTEGER NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS path_rewrite_directories (
+			rewrite_id INTEGER NOT NULL REFERENCES path_rewrites(id),
+			directory_id INTEGER NOT NULL,
+			old_path TEXT NOT NULL,
+			PRIMARY KEY (rewrite_id, directory_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS path_rewrite_entries (
+			rewrite_id INTEGER NOT NULL REFERENCES path_rewrites(id),
+			history_id INTEGER NOT NULL,
+			old_directory TEXT NOT NULL,
+			PRIMARY KEY (rewrite_id, history_id)
+		)`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to create path rewrite journal: %w", err)
+		}
+	}
+	return nil
+}
+
+// restoreEntries moves the entries matching the SQL condition where back to
+// dir. The condition refers to the history table as h.
+func restoreEntries(ctx context.Context, tx *sql.Tx, dir, where string, args ...interface{}) error {
+	dirID, err := ensureDirectory(ctx, tx, dir)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE history AS h SET directory_id = ? WHERE "+where,
+		append([]interface{}{dirID}, args...)...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to restore paths: %w", err)
+	}
+	return nil
+}
+
+// moveRepositoryRoots rewrites the recorded git repository roots under
+// oldPath to newPath for the entries matching the SQL condition where,
+// which refers to the history table as h
+func moveRepositoryRoots(ctx context.Context, tx *sql.Tx, oldPath, newPath, where string, whereArgs ...interface{}) error {
+	cond, args := subtreeCondition("git_root", oldPath)
+	args = append(append([]interface{}{oldPath, newPath}, whereArgs...), args...)
+	_, err := tx.ExecContext(ctx,
+		"UPDATE history AS h SET git_root = rewrite_prefix(git_root, ?, ?) WHERE "+where+" AND "+cond,
+		args...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update repository roots: %w", err)
+	}
+	return nil
+}
+
+// subtreeCondition returns an SQL condition matching column against dir
+// and its subdirectories. GLOB is used rather than LIKE because it is case
+// sensitive, and wildcards in dir are escaped so they match literally.
+func subtreeCondition(column, dir string) (string, []interface{}) {
+	pattern := escapeGlob(trimTrailingSlash(dir)) + "/*"
+	if dir == "/" {
+		pattern = "/*"
+	}
+	return "(" + column + " = ? OR " + column + " GLOB ?)", []interface{}{dir, pattern}
+}
+
+// directoryCondition returns an SQL condition matching the directory ID
+// column against any of dirs according to mode
+func directoryCondition(column string, dirs []string, mode DirMode) (string, []interface{}, error) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	for _, dir := range dirs {
+		switch mode {
+		case DirSubtree:
+			cond, condArgs := subtreeCondition("path", dir)
+			conds = append(conds, cond)
+			args = append(args, condArgs...)
+		case DirExact:
+			conds = append(conds, "path = ?")
+			args = append(args, dir)
+		default:
+			return "", nil, fmt.Errorf("unknown directory mode: %d", mode)
+		}
+	}
+	return column + " IN (SELECT id FROM directories WHERE " + strings.Join(conds, " OR ") + ")", args, nil
+}
+
+// escapeGlob escapes the GLOB wildcards in s by wrapping them in brackets
+func escapeGlob(s string) string {
+	return strings.NewReplacer("*", "[*]", "?", "[?]", "[", "[[]").Replace(s)
+}
+
+// rewritePrefix replaces the leading oldPath of dir with newPath. It is
+// also available to SQL as rewrite_prefix(dir, oldPath, newPath).
+func rewritePrefix(dir, oldPath, newPath string) string {
+	// Below the root, the rest of dir starts with its separator
+	rest := strings.TrimPrefix(dir, oldPath)
+	if oldPath == "/" && dir != "/" {
+		rest = dir
+	}
+	if newPath == "/" && rest != "" {
+		return rest
+	}
+	return newPath + rest
+}
+
+// trimTrailingSlash removes a trailing slash from any path but the root
+func trimTrailingSlash(path string) string {
+	if len(path) > 1 {
+		return strings.TrimSuffix(path, "/")
+	}
+	return path
+}
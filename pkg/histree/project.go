@@ -0,0 +1,33 @@
+package histree
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// DefaultRootMarkers are the files and directories marking a project root
+// when Query.RootMarkers is nil
+var DefaultRootMarkers = []string{".git", "go.mod", "package.json"}
+
+// FindProjectRoot returns the nearest directory at or above dir containing
+// one of markers. It returns "" if there is none or dir does not exist.
+func FindProjectRoot(dir string, markers []string) string {
+	dir = filepath.Clean(dir)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return ""
+	}
+
+	for {
+		for _, marker := range markers {
+			if _, err := os.Stat(filepath.Join(dir, marker)); err == nil {
+				return dir
+			}
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,615 @@
+package histree
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// DirMode controls how Query.Directory is matched
+type DirMode int
+
+const (
+	// DirSubtree matches the directory and all of its subdirectories
+	DirSubtree DirMode = iota
+	// DirExact matches only the directory itself
+	DirExact
+	// DirProject matches the whole project containing the directory: the
+	// subtree of the nearest ancestor holding one of Query.RootMarkers.
+	// Without a project root it behaves like DirSubtree.
+	DirProject
+	// DirAncestors matches the directory itself and each of its ancestors,
+	// ranking entries by HistoryEntry.Distance, nearest directory first.
+	// It suits fresh subdirectories that have no history of their own.
+	DirAncestors
+)
+
+// Order controls the order in which query results are returned
+type Order int
+
+const (
+	// OrderOldestFirst returns entries in chronological order
+	OrderOldestFirst Order = iota
+	// OrderNewestFirst returns the most recent entry first
+	OrderNewestFirst
+)
+
+// OrderAscending and OrderDescending name the orders for sort keys other than time
+const (
+	OrderAscending  = OrderOldestFirst
+	OrderDescending = OrderNewestFirst
+)
+
+// SortKey selects the value query results are ranked and ordered by
+type SortKey int
+
+const (
+	// SortTime ranks entries by timestamp
+	SortTime SortKey = iota
+	// SortDuration ranks entries by how long they ran. Entries without a
+	// recorded duration are excluded.
+	SortDuration
+	// SortFrecency ranks commands by frecency, a score combining how often
+	// and how recently they were run among the matching entries. It implies
+	// Query.Unique.
+	SortFrecency
+)
+
+// Query describes which history entries to retrieve. Zero values disable
+// the corresponding filter, so the zero Query matches every entry.
+type Query struct {
+	// Directory restricts entries to a directory, matched according to
+	// DirMode. Directories related to it by an alias match as well.
+	Directory string
+	DirMode   DirMode
+	// RootMarkers are the file names marking a project root for DirProject;
+	// nil selects DefaultRootMarkers
+	RootMarkers []string
+
+	// Hostname restricts entries to commands run on the given host
+	Hostname string
+	// ProcessID restricts entries to commands run by the given shell process
+	ProcessID int
+	// SessionID restricts entries to commands run in the given session
+	SessionID string
+	// Repository restricts entries to commands run in a git repository,
+	// given by its remote URL or root directory (see Repository.ID). Matching
+	// by remote follows a project across clones and worktrees.
+	Repository string
+
+	// ExitCodes restricts entries to commands that exited with one of the codes
+	ExitCodes []int
+	// FailedOnly restricts entries to commands with a non-zero exit code,
+	// excluding those whose exit code is unknown
+	FailedOnly bool
+
+	// Since and Until restrict entries to the half-open range [Since, Until)
+	Since time.Time
+	Until time.Time
+
+	// Contains restricts entries to commands containing the substring
+	Contains string
+	// Regexp restricts entries to commands matching the Go regular expression
+	Regexp string
+	// Glob restricts entries to commands matching the SQLite GLOB pattern
+	Glob string
+
+	// MinDuration and MaxDuration restrict entries to commands whose
+	// recorded duration lies in [MinDuration, MaxDuration]
+	MinDuration time.Duration
+	MaxDuration time.Duration
+
+	// Limit is the maximum number of entries to return; zero means no limit.
+	// The entries ranking highest by SortBy (the most recent or the longest
+	// running) are selected, then returned in Order of that key.
+	Limit int
+	// Offset skips the given number of highest ranking matching entries
+	Offset int
+	Order  Order
+	SortBy SortKey
+
+	// Unique returns only the latest occurrence of each command
+	Unique bool
+}
+
+// RankedEntry is the latest occurrence of a command, with statistics over
+// all of its occurrences matching the query
+type RankedEntry struct {
+	HistoryEntry
+	// Count is how many times the command was run
+	Count int `json:"count"`
+	// LastUsed is when the command was last run
+	LastUsed time.Time `json:"last_used"`
+	// Score is the command's frecency
+	Score float64 `json:"score"`
+}
+
+// frecencyWeights score each run of a command according to its age
+var frecencyWeights = []struct {
+	age    time.Duration
+	weight float64
+}{
+	{time.Hour, 4},
+	{24 * time.Hour, 2},
+	{7 * 24 * time.Hour, 0.5},
+}
+
+// frecencyWeightOlder is the score of runs older than every frecencyWeights age
+const frecencyWeightOlder = 0.25
+
+// driverName is the database/sql driver used by OpenDB. It is the sqlite3
+// driver with extra SQL functions and pragmas set up on each connection.
+const driverName = "sqlite3_histree"
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			// temp_store has no go-sqlite3 DSN parameter
+			if _, err := conn.Exec("PRAGMA temp_store = MEMORY", nil); err != nil {
+				return err
+			}
+			if err := conn.RegisterFunc("rewrite_prefix", rewritePrefix, true); err != nil {
+				return err
+			}
+			return conn.RegisterFunc("regexp", regexpMatch, true)
+		},
+	})
+}
+
+// regexpCacheSize bounds the number of compiled patterns kept by regexpMatch
+const regexpCacheSize = 16
+
+// regexpCache keeps the most recently used compiled patterns, since
+// regexpMatch is called once per row
+var regexpCache = struct {
+	sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+}{order: list.New(), items: map[string]*list.Element{}}
+
+// compileRegexp returns the compiled pattern from regexpCache, compiling it
+// and evicting the least recently used pattern if it is not cached
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	regexpCache.Lock()
+	defer regexpCache.Unlock()
+
+	if elem, ok := regexpCache.items[pattern]; ok {
+		regexpCache.order.MoveToFront(elem)
+		return elem.Value.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexpCache.items[pattern] = regexpCache.order.PushFront(re)
+	if regexpCache.order.Len() > regexpCacheSize {
+		oldest := regexpCache.order.Back()
+		regexpCache.order.Remove(oldest)
+		delete(regexpCache.items, oldest.Value.(*regexp.Regexp).String())
+	}
+	return re, nil
+}
+
+// regexpMatch implements the SQL "pattern REGEXP value" operator
+func regexpMatch(pattern, value string) (bool, error) {
+	re, err := compileRegexp(pattern)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(value), nil
+}
+
+// entryColumns lists the history_entries columns scanned by scanEntry.
+// qualifiedEntryColumns is the same list for queries aliasing it as h.
+const (
+	entryColumns          = "command, directory, timestamp, exit_code, hostname, process_id, session_id, started_at, duration_ms, git_root, git_branch, git_commit, git_remote"
+	qualifiedEntryColumns = "h.command, h.directory, h.timestamp, h.exit_code, h.hostname, h.process_id, h.session_id, h.started_at, h.duration_ms, h.git_root, h.git_branch, h.git_commit, h.git_remote"
+)
+
+// scanEntry reads a row selected with entryColumns, followed by any extra
+// columns, which are scanned into extra
+func scanEntry(rows *sql.Rows, extra ...interface{}) (HistoryEntry, error) {
+	var (
+		entry      HistoryEntry
+		sessionID  sql.NullString
+		startedAt  sql.NullTime
+		durationMS sql.NullInt64
+		gitRoot    sql.NullString
+		gitBranch  sql.NullString
+		gitCommit  sql.NullString
+		gitRemote  sql.NullString
+	)
+	dest := []interface{}{
+		&entry.Command,
+		&entry.Directory,
+		&entry.Timestamp,
+		&entry.ExitCode,
+		&entry.Hostname,
+		&entry.ProcessID,
+		&sessionID,
+		&startedAt,
+		&durationMS,
+		&gitRoot,
+		&gitBranch,
+		&gitCommit,
+		&gitRemote,
+	}
+	err := rows.Scan(append(dest, extra...)...)
+	if err != nil {
+		return entry, fmt.Errorf("failed to scan row: %w", err)
+	}
+	entry.SessionID = sessionID.String
+	if startedAt.Valid {
+		entry.StartedAt = &startedAt.Time
+	}
+	entry.Duration = time.Duration(durationMS.Int64) * time.Millisecond
+	if gitRoot.Valid {
+		entry.Repository = &Repository{
+			Root:   gitRoot.String,
+			Branch: gitBranch.String,
+			Commit: gitCommit.String,
+			Remote: gitRemote.String,
+		}
+	}
+	return entry, nil
+}
+
+// where returns the SQL condition selecting the entries matched by q. dirs
+// holds q.Directory expanded with its aliases.
+func (q Query) where(dirs []string) (string, []interface{}, error) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+
+	if len(dirs) > 0 {
+		cond, condArgs, err := directoryCondition("directory_id", dirs, q.DirMode)
+		if err != nil {
+			return "", nil, err
+		}
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+
+	if q.Hostname != "" {
+		conds = append(conds, "hostname = ?")
+		args = append(args, q.Hostname)
+	}
+
+	if q.ProcessID != 0 {
+		conds = append(conds, "process_id = ?")
+		args = append(args, q.ProcessID)
+	}
+
+	if q.SessionID != "" {
+		conds = append(conds, "session_id = ?")
+		args = append(args, q.SessionID)
+	}
+
+	if q.Repository != "" {
+		conds = append(conds, "(git_remote = ? OR git_root = ?)")
+		args = append(args, q.Repository, q.Repository)
+	}
+
+	if len(q.ExitCodes) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(q.ExitCodes)), ", ")
+		conds = append(conds, "exit_code IN ("+placeholders+")")
+		for _, code := range q.ExitCodes {
+			args = append(args, code)
+		}
+	}
+
+	if q.FailedOnly {
+		conds = append(conds, "exit_code NOT IN (0, ?)")
+		args = append(args, ExitCodeUnknown)
+	}
+
+	// Timestamps are stored in UTC, so compare against UTC values
+	if !q.Since.IsZero() {
+		conds = append(conds, "timestamp >= ?")
+		args = append(args, q.Since.UTC())
+	}
+
+	if !q.Until.IsZero() {
+		conds = append(conds, "timestamp < ?")
+		args = append(args, q.Until.UTC())
+	}
+
+	if q.Contains != "" {
+		conds = append(conds, "instr(command, ?) > 0")
+		args = append(args, q.Contains)
+	}
+
+	if q.Regexp != "" {
+		// Reject invalid patterns before SQLite evaluates them row by row
+		if _, err := regexp.Compile(q.Regexp); err != nil {
+			return "", nil, fmt.Errorf("invalid regular expression: %w", err)
+		}
+		conds = append(conds, "command REGEXP ?")
+		args = append(args, q.Regexp)
+	}
+
+	if q.Glob != "" {
+		conds = append(conds, "command GLOB ?")
+		args = append(args, q.Glob)
+	}
+
+	if q.MinDuration > 0 {
+		conds = append(conds, "duration_ms >= ?")
+		args = append(args, q.MinDuration.Milliseconds())
+	}
+
+	if q.MaxDuration > 0 {
+		conds = append(conds, "duration_ms <= ?")
+		args = append(args, q.MaxDuration.Milliseconds())
+	}
+
+	switch q.SortBy {
+	case SortTime, SortFrecency:
+	case SortDuration:
+		conds = append(conds, "duration_ms IS NOT NULL")
+	default:
+		return "", nil, fmt.Errorf("unknown sort key: %d", q.SortBy)
+	}
+
+	if len(conds) == 0 {
+		return "1 = 1", args, nil
+	}
+	return strings.Join(conds, " AND "), args, nil
+}
+
+// projectScope replaces a DirProject query by a DirSubtree query for the
+// project root
+func (q Query) projectScope() Query {
+	q.DirMode = DirSubtree
+	if q.Directory == "" {
+		return q
+	}
+
+	markers := q.RootMarkers
+	if markers == nil {
+		markers = DefaultRootMarkers
+	}
+	if root := FindProjectRoot(q.Directory, markers); root != "" {
+		q.Directory = root
+	}
+	return q
+}
+
+// ancestorDistances returns dir and its ancestors, each expanded with its
+// aliases, and an SQL expression giving the distance of an entry's
+// directory from dir
+func (db *DB) ancestorDistances(ctx context.Context, dir string) ([]string, string, []interface{}, error) {
+	var (
+		dirs  []string
+		whens []string
+		args  []interface{}
+	)
+	distance := 0
+	for path := trimTrailingSlash(dir); path != ""; path = parentDir(path) {
+		expanded, err := db.expandDirectory(ctx, path, DirExact)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		for _, p := range expanded {
+			dirs = append(dirs, p)
+			whens = append(whens, "WHEN ? THEN ?")
+			args = append(args, p, distance)
+		}
+		distance++
+	}
+	return dirs, "CASE directory " + strings.Join(whens, " ") + " END", args, nil
+}
+
+// Find retrieves the history entries matching q
+func (db *DB) Find(ctx context.Context, q Query) ([]HistoryEntry, error) {
+	entries := []HistoryEntry{}
+	err := db.Iterate(ctx, q, func(entry HistoryEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Iterate calls fn for each history entry matching q, in the order Find
+// would return them, without loading the whole result set into memory.
+// Iteration stops at the first error returned by fn, which Iterate returns.
+func (db *DB) Iterate(ctx context.Context, q Query, fn func(HistoryEntry) error) error {
+	return db.iterate(ctx, q, func(ranked RankedEntry) error {
+		return fn(ranked.HistoryEntry)
+	})
+}
+
+// RankedEntries returns the latest occurrence of each command matching q,
+// with how often and when it was last run. Entries are ranked and ordered
+// according to q.SortBy; use SortFrecency to rank by frecency.
+func (db *DB) RankedEntries(ctx context.Context, q Query) ([]RankedEntry, error) {
+	q.Unique = true
+	entries := []RankedEntry{}
+	err := db.iterate(ctx, q, func(ranked RankedEntry) error {
+		entries = append(entries, ranked)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (db *DB) iterate(ctx context.Context, q Query, fn func(RankedEntry) error) error {
+	query, args, ancestors, err := db.iterateQuery(ctx, q)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query entries: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			ranked   RankedEntry
+			distance int
+		)
+		ranked.HistoryEntry, err = scanEntry(rows, &distance, &ranked.Count, &ranked.Score)
+		if err != nil {
+			return err
+		}
+		if ancestors {
+			ranked.Distance = &distance
+		}
+		ranked.LastUsed = ranked.Timestamp
+		if err := fn(ranked); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error during row iteration: %w", err)
+	}
+
+	return nil
+}
+
+// iterateQuery returns the SQL query and arguments iterate reads the
+// entries matching q with, and whether they are ranked by their distance
+// from q.Directory
+func (db *DB) iterateQuery(ctx context.Context, q Query) (string, []interface{}, bool, error) {
+	if q.DirMode == DirProject {
+		q = q.projectScope()
+	}
+	if q.SortBy == SortFrecency {
+		q.Unique = true
+	}
+
+	// In ancestor mode, entries are first ranked by how far up they are
+	var (
+		dirs         []string
+		distance     = "0"
+		distanceArgs []interface{}
+		err          error
+	)
+	if q.DirMode == DirAncestors && q.Directory != "" {
+		dirs, distance, distanceArgs, err = db.ancestorDistances(ctx, q.Directory)
+		q.DirMode = DirExact
+	} else {
+		dirs, err = db.expandDirectory(ctx, q.Directory, q.DirMode)
+	}
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	where, whereArgs, err := q.where(dirs)
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+
+	key := "timestamp"
+	switch q.SortBy {
+	case SortDuration:
+		key = "duration_ms"
+	case SortFrecency:
+		key = "score"
+	}
+
+	// Outside ancestor mode the distance is the same for every entry
+	rank, outerOrder := key+" DESC, id DESC", key+" ASC, id ASC"
+	if q.Order == OrderNewestFirst {
+		outerOrder = rank
+	}
+	if len(distanceArgs) > 0 {
+		rank = "distance ASC, " + rank
+		if q.Order == OrderNewestFirst {
+			outerOrder = "distance ASC, " + outerOrder
+		} else {
+			outerOrder = "distance DESC, " + outerOrder
+		}
+	}
+
+	weight, args := "0", distanceArgs
+	if q.Unique {
+		weight, args = db.frecencyWeight(args)
+	}
+	args = append(args, whereArgs...)
+
+	// With Unique, only the latest occurrence of each command is kept,
+	// carrying statistics over all of its occurrences
+	matched := `SELECT *, 1 AS occurrence, 1 AS uses, weight AS score FROM scoped`
+	if q.Unique {
+		matched = `
+			SELECT *,
+				ROW_NUMBER() OVER (PARTITION BY command ORDER BY timestamp DESC, id DESC) AS occurrence,
+				COUNT(*) OVER (PARTITION BY command) AS uses,
+				SUM(weight) OVER (PARTITION BY command) AS score
+			FROM scoped`
+	}
+
+	query := `
+		WITH scoped AS (
+			SELECT id, ` + entryColumns + `, ` + distance + ` AS distance, ` + weight + ` AS weight
+			FROM history_entries
+			WHERE ` + where + `
+		),
+		matched AS (` + matched + `)`
+
+	if limit < 0 && q.Offset == 0 {
+		// Without Limit and Offset every match is returned, so the rows
+		// are read in the output order and streamed as they are found
+		query += `
+		SELECT ` + entryColumns + `, distance, uses, score FROM matched
+		WHERE occurrence = 1
+		ORDER BY ` + outerOrder
+	} else {
+		// Select the highest ranking matches first so Limit and Offset
+		// count back from the most recent (or longest) entry, then apply
+		// the requested output order
+		query += `,
+		selected AS (
+			SELECT * FROM matched
+			WHERE occurrence = 1
+			ORDER BY ` + rank + `
+			LIMIT ? OFFSET ?
+		)
+		SELECT ` + entryColumns + `, distance, uses, score FROM selected ORDER BY ` + outerOrder
+		args = append(args, limit, q.Offset)
+	}
+	return query, args, len(distanceArgs) > 0, nil
+}
+
+// migrateIndexTimestamps indexes history by time, the order Iterate streams
+// entries in
+func migrateIndexTimestamps(ctx context.Context, tx *sql.Tx) error {
+	if _, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_history_timestamp ON history(timestamp)`); err != nil {
+		return fmt.Errorf("failed to create index: %w", err)
+	}
+	return nil
+}
+
+// frecencyWeight returns an SQL expression scoring an entry by its age,
+// appending its arguments to args
+func (db *DB) frecencyWeight(args []interface{}) (string, []interface{}) {
+	now := db.now().UTC()
+	expr := "CASE"
+	for _, w := range frecencyWeights {
+		expr += " WHEN timestamp >= ? THEN ?"
+		args = append(args, now.Add(-w.age), w.weight)
+	}
+	return expr + " ELSE ? END", append(args, frecencyWeightOlder)
+}
@@ -0,0 +1,72 @@
+package histree
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestIterateStreams tests that iterating over every entry reads them in
+// index order instead of sorting the whole history first
+func TestIterateStreams(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "histree.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	for _, q := range []Query{{}, {Order: OrderNewestFirst}} {
+		query, args, _, err := db.iterateQuery(ctx, q)
+		if err != nil {
+			t.Fatalf("Failed to build query: %v", err)
+		}
+		rows, err := db.QueryContext(ctx, "EXPLAIN QUERY PLAN "+query, args...)
+		if err != nil {
+			t.Fatalf("Failed to explain query: %v", err)
+		}
+		var plan []string
+		for rows.Next() {
+			var (
+				id, parent, unused int
+				detail             string
+			)
+			if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+				t.Fatalf("Failed to scan row: %v", err)
+			}
+			plan = append(plan, detail)
+		}
+		rows.Close()
+
+		if joined := strings.Join(plan, "\n"); strings.Contains(joined, "TEMP B-TREE") {
+			t.Errorf("Query for order %d sorts in a temporary B-tree:\n%s", q.Order, joined)
+		}
+	}
+}
+
+// TestRegexpCacheBounded tests that the regexp cache keeps only the most
+// recently used patterns
+func TestRegexpCacheBounded(t *testing.T) {
+	for i := 0; i < regexpCacheSize*2; i++ {
+		if _, err := regexpMatch(fmt.Sprintf("^cmd%d$", i), "cmd"); err != nil {
+			t.Fatalf("Failed to match: %v", err)
+		}
+	}
+	if _, err := regexpMatch("^cmd0$", "cmd0"); err != nil {
+		t.Fatalf("Failed to match: %v", err)
+	}
+
+	regexpCache.Lock()
+	defer regexpCache.Unlock()
+	if n := len(regexpCache.items); n != regexpCacheSize || regexpCache.order.Len() != n {
+		t.Errorf("Expected %d cached patterns, got %d", regexpCacheSize, n)
+	}
+	if _, ok := regexpCache.items["^cmd0$"]; !ok {
+		t.Error("Expected the last used pattern to be cached")
+	}
+	if _, ok := regexpCache.items["^cmd1$"]; ok {
+		t.Error("Expected the least recently used pattern to be evicted")
+	}
+}
@@ -0,0 +1,294 @@
+package histree
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultReconcileDepth is how many directory levels below each root
+// Reconcile searches when ReconcileOptions.MaxDepth is zero
+const DefaultReconcileDepth = 6
+
+// Reasons a DirectoryMove was proposed
+const (
+	// MatchInode means the directory now at NewPath has the device and
+	// inode numbers recorded when commands were run in OldPath. Inode
+	// numbers are reused after a directory is deleted, so when another
+	// directory shares OldPath's name, both are offered as candidates.
+	MatchInode = "inode"
+	// MatchRemote means NewPath is the only git repository under the search
+	// roots with the remote recorded for OldPath
+	MatchRemote = "remote"
+	// MatchBasename means NewPath is the only directory under the search
+	// roots with the same name as OldPath
+	MatchBasename = "basename"
+)
+
+// ReconcileOptions controls Reconcile
+type ReconcileOptions struct {
+	// Roots are the directories searched for the new locations of missing
+	// directories
+	Roots []string
+	// MaxDepth limits how deep below each root the search descends. Zero
+	// selects DefaultReconcileDepth.
+	MaxDepth int
+	// Hostname restricts the check to directories recorded on this host,
+	// since directories from other machines cannot be found locally
+	Hostname string
+}
+
+// DirectoryMove proposes moving the history of OldPath, which no longer
+// exists, to NewPath. Moves that could not be resolved to a single
+// directory have an empty NewPath and list the possible locations in
+// Candidates. Entries counts the entries the move would rewrite, including
+// those in subdirectories of OldPath.
+type DirectoryMove struct {
+	OldPath    string   `json:"old_path"`
+	NewPath    string   `json:"new_path,omitempty"`
+	Reason     string   `json:"reason,omitempty"`
+	Entries    int64    `json:"entries"`
+	Candidates []string `json:"candidates,omitempty"`
+}
+
+// Reconcile finds recorded directories that no longer exist and proposes
+// where they were moved to. It does not change the database; apply the
+// proposals with RewritePaths or UpdatePaths. Directories are matched by
+// the inode recorded when commands were run in them, then, for repository
+// roots, by git remote, and finally by name. When a directory and its
+// subdirectories are all missing, only the topmost one is proposed, since
+// rewriting it moves the whole subtree.
+func (db *DB) Reconcile(ctx context.Context, opts ReconcileOptions) ([]DirectoryMove, error) {
+	if len(opts.Roots) == 0 {
+		return nil, errors.New("at least one search root is required")
+	}
+	if opts.MaxDepth == 0 {
+		opts.MaxDepth = DefaultReconcileDepth
+	}
+
+	missing, err := db.missingDirectories(ctx, opts.Hostname)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) == 0 {
+		return []DirectoryMove{}, nil
+	}
+
+	index, err := indexDirectories(ctx, opts.Roots, opts.MaxDepth)
+	if err != nil {
+		return nil, err
+	}
+
+	moves := []DirectoryMove{}
+	var resolved []string
+	for _, dir := range missing {
+		if underAny(dir.path, resolved) {
+			continue
+		}
+
+		move := DirectoryMove{OldPath: dir.path}
+		candidates := index.byName[filepath.Base(dir.path)]
+		inodePath, inodeMatch := index.byID[dir.id]
+		var clones []string
+		if dir.remote != "" {
+			clones = index.byRemote[dir.remote]
+		}
+		switch {
+		case dir.hasID && inodeMatch && (len(candidates) == 0 || filepath.Base(inodePath) == filepath.Base(dir.path)):
+			move.NewPath = inodePath
+			move.Reason = MatchInode
+		case dir.hasID && inodeMatch:
+			// A renamed directory, or a reused inode: let the user decide
+			move.Candidates = append([]string{inodePath}, candidates...)
+		case len(clones) == 1:
+			move.NewPath = clones[0]
+			move.Reason = MatchRemote
+		case len(clones) > 1:
+			move.Candidates = clones
+		case len(candidates) == 0:
+			continue
+		case len(candidates) == 1:
+			move.NewPath = candidates[0]
+			move.Reason = MatchBasename
+		default:
+			move.Candidates = candidates
+		}
+
+		if move.Entries, err = db.countSubtree(ctx, dir.path); err != nil {
+			return nil, err
+		}
+		if move.NewPath != "" {
+			resolved = append(resolved, dir.path)
+		}
+		moves = append(moves, move)
+	}
+
+	return moves, nil
+}
+
+type dirID struct{ device, inode int64 }
+
+type missingDirectory struct {
+	path   string
+	id     dirID
+	hasID  bool
+	remote string
+}
+
+// missingDirectories returns the recorded directories that do not exist,
+// parents before their subdirectories
+func (db *DB) missingDirectories(ctx context.Context, hostname string) ([]missingDirectory, error) {
+	query := "SELECT DISTINCT directory FROM history_entries WHERE directory != ''"
+	var args []interface{}
+	if hostname != "" {
+		query += " AND hostname = ?"
+		args = append(args, hostname)
+	}
+	query += " ORDER BY directory"
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query directories: %w", err)
+	}
+	defer rows.Close()
+
+	var missing []missingDirectory
+	for rows.Next() {
+		var dir missingDirectory
+		if err := rows.Scan(&dir.path); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if _, err := os.Stat(dir.path); errors.Is(err, fs.ErrNotExist) {
+			missing = append(missing, dir)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during row iteration: %w", err)
+	}
+	rows.Close()
+
+	for i := range missing {
+		err := db.QueryRowContext(ctx,
+			"SELECT dir_device, dir_inode FROM history_entries WHERE directory = ? AND dir_inode IS NOT NULL ORDER BY id DESC LIMIT 1",
+			missing[i].path,
+		).Scan(&missing[i].id.device, &missing[i].id.inode)
+		if err == nil {
+			missing[i].hasID = true
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("failed to query directory inode: %w", err)
+		}
+
+		// Repository roots can be recognized by their remote
+		err = db.QueryRowContext(ctx,
+			"SELECT git_remote FROM history WHERE git_root = ? AND git_remote IS NOT NULL ORDER BY id DESC LIMIT 1",
+			missing[i].path,
+		).Scan(&missing[i].remote)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("failed to query repository remote: %w", err)
+		}
+	}
+
+	// Parents have fewer path separators than their subdirectories
+	sort.SliceStable(missing, func(i, j int) bool {
+		return strings.Count(missing[i].path, "/") < strings.Count(missing[j].path, "/")
+	})
+	return missing, nil
+}
+
+// countSubtree returns the number of entries recorded in dir and its
+// subdirectories, which rewriting dir moves
+func (db *DB) countSubtree(ctx context.Context, dir string) (int64, error) {
+	cond, args, err := directoryCondition("directory_id", []string{dir}, DirSubtree)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM history WHERE "+cond, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count entries: %w", err)
+	}
+	return count, nil
+}
+
+// directoryIndex locates the existing directories under the search roots
+type directoryIndex struct {
+	byID     map[dirID]string
+	byName   map[string][]string
+	byRemote map[string][]string
+}
+
+// indexDirectories walks roots up to maxDepth levels deep, skipping hidden
+// directories
+func indexDirectories(ctx context.Context, roots []string, maxDepth int) (*directoryIndex, error) {
+	index := &directoryIndex{
+		byID:     map[dirID]string{},
+		byName:   map[string][]string{},
+		byRemote: map[string][]string{},
+	}
+
+	visited := map[string]bool{}
+	for _, root := range roots {
+		root = filepath.Clean(root)
+		depth := strings.Count(root, string(filepath.Separator))
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// Unreadable directories cannot hold the moved directory
+				if path != root && errors.Is(err, fs.ErrPermission) {
+					return fs.SkipDir
+				}
+				return err
+			}
+			if !d.IsDir() {
+				return nil
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if visited[path] || path != root && strings.HasPrefix(d.Name(), ".") {
+				return fs.SkipDir
+			}
+			visited[path] = true
+
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			if dev, ino, ok := fileInfoID(info); ok {
+				if _, seen := index.byID[dirID{dev, ino}]; !seen {
+					index.byID[dirID{dev, ino}] = path
+				}
+			}
+			index.byName[d.Name()] = append(index.byName[d.Name()], path)
+			if gitInfo, err := os.Stat(filepath.Join(path, ".git")); err == nil {
+				if repo, err := readRepository(path, filepath.Join(path, ".git"), gitInfo); err == nil && repo.Remote != "" {
+					index.byRemote[repo.Remote] = append(index.byRemote[repo.Remote], path)
+				}
+			}
+
+			if strings.Count(path, string(filepath.Separator))-depth >= maxDepth {
+				return fs.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to search %s: %w", root, err)
+		}
+	}
+
+	return index, nil
+}
+
+// underAny reports whether path is one of dirs or inside one of them
+func underAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if isUnder(path, dir) {
+			return true
+		}
+	}
+	return false
+}
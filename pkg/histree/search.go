@@ -0,0 +1,275 @@
+package histree
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// SearchQuery describes a full-text search over recorded commands
+type SearchQuery struct {
+	// Text is the search text. Each whitespace separated word must appear
+	// in the command; words are matched as literal tokens.
+	Text string
+	// Raw passes Text to the FTS5 index unmodified, allowing the full
+	// FTS5 query syntax (prefix queries, NEAR, OR, ...).
+	Raw bool
+	// Directory restricts results to a directory and its subdirectories,
+	// including those related to it by an alias
+	Directory string
+	// Limit is the maximum number of results; zero means no limit
+	Limit int
+}
+
+// migrateCreateFTS creates the search_index table, which records the last
+// entry the history_fts index covers. The index itself is created and kept
+// up to date by builds with FTS5 (see the sqlite_fts5 build tag of
+// go-sqlite3) in syncSearchIndex and indexEntries rather than by triggers,
+// so builds without FTS5 can still add entries to the database. Search
+// falls back to scanning the history table when the index is unavailable.
+func migrateCreateFTS(ctx context.Context, tx *sql.Tx) error {
+	queries := []string{
+		`CREATE TABLE IF NOT EXISTS search_index (
+			last_history_id INTEGER NOT NULL
+		)`,
+		`INSERT INTO search_index (last_history_id)
+			SELECT 0 WHERE NOT EXISTS (SELECT 1 FROM search_index)`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to create search index: %w", err)
+		}
+	}
+	return nil
+}
+
+// syncSearchIndex detects whether SQLite has FTS5. If so and update is set,
+// it creates the history_fts index and indexes the entries added since it
+// was last updated, including those added by builds without FTS5.
+func (db *DB) syncSearchIndex(ctx context.Context, update bool) error {
+	var available bool
+	if err := db.QueryRowContext(ctx, "SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&available); err != nil {
+		return fmt.Errorf("failed to detect FTS5 support: %w", err)
+	}
+	if !available {
+		return nil
+	}
+
+	if update {
+		current, err := db.searchIndexCurrent(ctx)
+		if err != nil {
+			return err
+		}
+		if !current {
+			err := db.withRetry(ctx, func() error {
+				tx, err := db.BeginTx(ctx, nil)
+				if err != nil {
+					return fmt.Errorf("failed to begin transaction: %w", err)
+				}
+				defer tx.Rollback()
+
+				if err := createSearchIndex(ctx, tx); err != nil {
+					return err
+				}
+				if err := indexEntries(ctx, tx); err != nil {
+					return err
+				}
+				return tx.Commit()
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, table := range []string{"history_fts", "search_index"} {
+		exists, err := tableExists(ctx, db.DB, table)
+		if err != nil || !exists {
+			return err
+		}
+	}
+	db.fts = true
+	return nil
+}
+
+// createSearchIndex creates the history_fts index unless it exists. A new
+// index starts out empty.
+func createSearchIndex(ctx context.Context, tx *sql.Tx) error {
+	var exists bool
+	err := tx.QueryRowContext(ctx,
+		"SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'history_fts'",
+	).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to inspect schema: %w", err)
+	}
+	if exists {
+		return nil
+	}
+
+	queries := []string{
+		`CREATE VIRTUAL TABLE history_fts USING fts5(
+			command,
+			content = 'history',
+			content_rowid = 'id'
+		)`,
+		`UPDATE search_index SET last_history_id = 0`,
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to create search index: %w", err)
+		}
+	}
+	return nil
+}
+
+// indexEntries adds the entries not yet in the history_fts index to it.
+// History is append-only, so these are the entries after the last one
+// indexed.
+func indexEntries(ctx context.Context, tx *sql.Tx) error {
+	queries := []string{
+		`INSERT INTO history_fts (rowid, command)
+			SELECT id, command FROM history
+			WHERE id > (SELECT last_history_id FROM search_index)`,
+		`UPDATE search_index SET last_history_id = (SELECT COALESCE(MAX(id), 0) FROM history)`,
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to update search index: %w", err)
+		}
+	}
+	return nil
+}
+
+// searchIndexCurrent reports whether the history_fts index exists and
+// covers every entry
+func (db *DB) searchIndexCurrent(ctx context.Context) (bool, error) {
+	exists, err := tableExists(ctx, db.DB, "history_fts")
+	if err != nil || !exists {
+		return false, err
+	}
+
+	var current bool
+	err = db.QueryRowContext(ctx,
+		"SELECT (SELECT last_history_id FROM search_index) >= (SELECT COALESCE(MAX(id), 0) FROM history)",
+	).Scan(&current)
+	if err != nil {
+		return false, fmt.Errorf("failed to check search index: %w", err)
+	}
+	return current, nil
+}
+
+// Search returns the history entries matching query, best match first.
+// Results are ranked with bm25 when the FTS5 index is available and covers
+// every entry, and by recency otherwise.
+func (db *DB) Search(query SearchQuery) ([]HistoryEntry, error) {
+	return db.SearchContext(context.Background(), query)
+}
+
+// SearchContext is like Search but aborts when ctx is done
+func (db *DB) SearchContext(ctx context.Context, query SearchQuery) ([]HistoryEntry, error) {
+	// Builds without FTS5 cannot read the index, and read-only databases
+	// may hold entries it is missing
+	indexed := false
+	if db.fts {
+		var err error
+		if indexed, err = db.searchIndexCurrent(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		sqlQuery string
+		args     []interface{}
+	)
+	if indexed {
+		match := query.Text
+		if !query.Raw {
+			match = ftsQuote(query.Text)
+		}
+		if match == "" {
+			return []HistoryEntry{}, nil
+		}
+		sqlQuery = `
+			SELECT ` + qualifiedEntryColumns + `
+			FROM history_fts
+			JOIN history_entries h ON h.id = history_fts.rowid
+			WHERE history_fts MATCH ?`
+		args = append(args, match)
+	} else {
+		words := strings.Fields(query.Text)
+		if len(words) == 0 {
+			return []HistoryEntry{}, nil
+		}
+		sqlQuery = `
+			SELECT ` + qualifiedEntryColumns + `
+			FROM history_entries h
+			WHERE 1 = 1`
+		for _, word := range words {
+			sqlQuery += ` AND h.command LIKE ? ESCAPE '\'`
+			args = append(args, "%"+escapeLike(word)+"%")
+		}
+	}
+
+	if query.Directory != "" {
+		dirs, err := db.expandDirectory(ctx, query.Directory, DirSubtree)
+		if err != nil {
+			return nil, err
+		}
+		cond, condArgs, err := directoryCondition("h.directory_id", dirs, DirSubtree)
+		if err != nil {
+			return nil, err
+		}
+		sqlQuery += ` AND ` + cond
+		args = append(args, condArgs...)
+	}
+
+	if indexed {
+		sqlQuery += ` ORDER BY bm25(history_fts), h.timestamp DESC`
+	} else {
+		sqlQuery += ` ORDER BY h.timestamp DESC`
+	}
+
+	if query.Limit > 0 {
+		sqlQuery += ` LIMIT ?`
+		args = append(args, query.Limit)
+	}
+
+	rows, err := db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search entries: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []HistoryEntry{}
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during row iteration: %w", err)
+	}
+
+	return entries, nil
+}
+
+// ftsQuote turns free text into an FTS5 query that matches every word
+// literally, so characters such as '-', '.' or ':' are not parsed as
+// query syntax.
+func ftsQuote(text string) string {
+	words := strings.Fields(text)
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	return strings.Join(words, " ")
+}
+
+// escapeLike escapes the LIKE wildcards in s using '\' as the escape character
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
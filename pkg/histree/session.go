@@ -0,0 +1,152 @@
+package histree
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrSessionNotFound is returned when a session ID does not exist
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session represents one interactive shell session. Unlike process IDs,
+// session IDs are never reused, so they reliably identify a terminal's history.
+type Session struct {
+	ID        string     `json:"id"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+	Shell     string     `json:"shell,omitempty"`
+	TTY       string     `json:"tty,omitempty"`
+	User      string     `json:"user,omitempty"`
+	Hostname  string     `json:"hostname,omitempty"`
+	ProcessID int        `json:"process_id,omitempty"`
+}
+
+func migrateCreateSessions(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT PRIMARY KEY,
+			started_at DATETIME NOT NULL,
+			ended_at DATETIME,
+			shell TEXT NOT NULL DEFAULT '',
+			tty TEXT NOT NULL DEFAULT '',
+			user TEXT NOT NULL DEFAULT '',
+			hostname TEXT NOT NULL DEFAULT '',
+			process_id INTEGER NOT NULL DEFAULT 0
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create sessions table: %w", err)
+	}
+
+	if err := addColumn(ctx, tx, "history", "session_id", "TEXT REFERENCES sessions(id)"); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_history_session_timestamp ON history(session_id, timestamp)`)
+	if err != nil {
+		return fmt.Errorf("failed to create index: %w", err)
+	}
+	return nil
+}
+
+// StartSession records a new session. An empty ID is replaced by a random
+// UUID and a zero StartedAt by the current time; both are written back to
+// session.
+func (db *DB) StartSession(ctx context.Context, session *Session) error {
+	if session.ID == "" {
+		id, err := newUUID()
+		if err != nil {
+			return err
+		}
+		session.ID = id
+	}
+	if session.StartedAt.IsZero() {
+		session.StartedAt = db.now().UTC()
+	}
+
+	err := db.withRetry(ctx, func() error {
+		_, err := db.ExecContext(ctx,
+			"INSERT INTO sessions (id, started_at, shell, tty, user, hostname, process_id) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			session.ID,
+			session.StartedAt.UTC(),
+			session.Shell,
+			session.TTY,
+			session.User,
+			session.Hostname,
+			session.ProcessID,
+		)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start session: %w", err)
+	}
+	return nil
+}
+
+// EndSession marks the session as ended at the current time
+func (db *DB) EndSession(ctx context.Context, id string) error {
+	var result sql.Result
+	err := db.withRetry(ctx, func() error {
+		var err error
+		result, err = db.ExecContext(ctx,
+			"UPDATE sessions SET ended_at = ? WHERE id = ?",
+			db.now().UTC(), id,
+		)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to end session: %w", err)
+	}
+
+	if count, _ := result.RowsAffected(); count == 0 {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	return nil
+}
+
+// GetSession returns the session with the given ID
+func (db *DB) GetSession(ctx context.Context, id string) (*Session, error) {
+	var (
+		session Session
+		endedAt sql.NullTime
+	)
+	err := db.QueryRowContext(ctx,
+		"SELECT id, started_at, ended_at, shell, tty, user, hostname, process_id FROM sessions WHERE id = ?",
+		id,
+	).Scan(
+		&session.ID,
+		&session.StartedAt,
+		&endedAt,
+		&session.Shell,
+		&session.TTY,
+		&session.User,
+		&session.Hostname,
+		&session.ProcessID,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+
+	if endedAt.Valid {
+		session.EndedAt = &endedAt.Time
+	}
+	return &session, nil
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate session ID: %w", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,263 @@
+package histree
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// suggestContext is the maximum number of previous commands matched
+// against recorded command sequences
+const suggestContext = 3
+
+// suggestScanLimit is the maximum number of runs of the last previous
+// command, or of any command without one, examined by Suggest
+const suggestScanLimit = 10000
+
+// suggestDirectoryBonus multiplies the score of commands followed in the
+// requested directory or its subdirectories
+const suggestDirectoryBonus = 2
+
+// SuggestRequest describes the state of a shell asking for its likely next
+// command
+type SuggestRequest struct {
+	// Directory is the current directory. Commands that followed the same
+	// sequence in it or its subdirectories score higher.
+	Directory string
+	// Previous are the last commands run in the shell, oldest first. Up to
+	// three of them are matched against recorded sequences.
+	Previous []string
+	// Hostname and ProcessID identify the shell. When Previous is empty,
+	// its last commands are read from the history instead.
+	Hostname  string
+	ProcessID int
+	// Prefix restricts suggestions to commands starting with it, such as
+	// what has been typed so far
+	Prefix string
+	// Limit is the maximum number of suggestions; zero means no limit
+	Limit int
+}
+
+// Suggestion is a candidate next command
+type Suggestion struct {
+	Command string `json:"command"`
+	// Score is the share of the matching history that ran the command next,
+	// weighted by how much of the sequence and the directory matched
+	Score float64 `json:"score"`
+	// Count is how many times the command followed the sequence
+	Count int `json:"count"`
+	// LastUsed is when the command last followed the sequence
+	LastUsed time.Time `json:"last_used"`
+}
+
+// migrateIndexSequences indexes history in the order commands were run in
+// each shell, which Suggest reads command sequences in
+func migrateIndexSequences(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_history_process_timestamp ON history(hostname, process_id, timestamp)`)
+	if err != nil {
+		return fmt.Errorf("failed to create sequence index: %w", err)
+	}
+	return nil
+}
+
+// migrateIndexCommands indexes history by command, which Suggest finds the
+// latest runs of the last previous command by
+func migrateIndexCommands(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_history_command_timestamp ON history(command, timestamp)`)
+	if err != nil {
+		return fmt.Errorf("failed to create command index: %w", err)
+	}
+	return nil
+}
+
+// Suggest returns the commands most likely to be run next, best first.
+// Commands are scored by how often they followed the previous commands in
+// any shell, counting longer matching sequences and runs in req.Directory
+// more. Without previous commands, the most frequent commands are returned.
+// Only the latest suggestScanLimit matching runs are taken into account.
+func (db *DB) Suggest(ctx context.Context, req SuggestRequest) ([]Suggestion, error) {
+	previous := req.Previous
+	if len(previous) == 0 && req.ProcessID != 0 {
+		var err error
+		if previous, err = db.lastCommands(ctx, req.Hostname, req.ProcessID); err != nil {
+			return nil, err
+		}
+	}
+	if len(previous) > suggestContext {
+		previous = previous[len(previous)-suggestContext:]
+	}
+
+	var (
+		args     []interface{}
+		prefix   = "1 = 1"
+		sequence string
+	)
+	if req.Prefix != "" {
+		prefix = "command GLOB ?"
+	}
+
+	if len(previous) == 0 {
+		// Every recent command is a candidate
+		sequence = `
+			sequences AS (
+				SELECT id AS next FROM history
+				WHERE ` + prefix + `
+				ORDER BY timestamp DESC, id DESC
+				LIMIT ?
+			)`
+		if req.Prefix != "" {
+			args = append(args, escapeGlob(req.Prefix)+"*")
+		}
+		args = append(args, suggestScanLimit)
+	} else {
+		// Start from the latest runs of the last previous command, then step
+		// back to the commands run before it and forward to the one run
+		// after it in the same shell
+		sequence = `
+			steps1 AS (
+				SELECT id AS prev1 FROM history
+				WHERE command = ?
+				ORDER BY timestamp DESC, id DESC
+				LIMIT ?
+			),`
+		args = append(args, previous[len(previous)-1], suggestScanLimit)
+		for i := 2; i <= len(previous); i++ {
+			sequence += fmt.Sprintf(`
+			steps%d AS (
+				SELECT *, %s AS prev%d FROM steps%d
+			),`, i, adjacentEntry(fmt.Sprintf("prev%d", i-1), false), i, i-1)
+		}
+		sequence += fmt.Sprintf(`
+			sequences AS (
+				SELECT *, %s AS next FROM steps%d
+			)`, adjacentEntry("prev1", true), len(previous))
+	}
+
+	// A command scores one point for each matching previous command, as
+	// long as the more recent ones matched too. The last one always does.
+	score, joins := "1", ""
+	for i := 2; i <= len(previous); i++ {
+		joins += fmt.Sprintf(" LEFT JOIN history p%d ON p%d.id = s.prev%d", i, i, i)
+		score += " + (p2.command IS ?"
+		args = append(args, previous[len(previous)-2])
+		for j := 3; j <= i; j++ {
+			score += " AND p" + strconv.Itoa(j) + ".command IS ?"
+			args = append(args, previous[len(previous)-j])
+		}
+		score += ")"
+	}
+
+	if req.Directory != "" {
+		dirs, err := db.expandDirectory(ctx, req.Directory, DirSubtree)
+		if err != nil {
+			return nil, err
+		}
+		cond, condArgs, err := directoryCondition("n.directory_id", dirs, DirSubtree)
+		if err != nil {
+			return nil, err
+		}
+		score = fmt.Sprintf("(%s) * CASE WHEN %s THEN %d ELSE 1 END", score, cond, suggestDirectoryBonus)
+		args = append(args, condArgs...)
+	}
+
+	if req.Prefix != "" {
+		prefix = "n." + prefix
+		args = append(args, escapeGlob(req.Prefix)+"*")
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	args = append(args, limit)
+
+	query := `
+		WITH ` + sequence + `,
+		matched AS (
+			SELECT n.id, n.command, n.timestamp, ` + score + ` AS score
+			FROM sequences s
+			JOIN history n ON n.id = s.next` + joins + `
+			WHERE ` + prefix + `
+		),
+		grouped AS (
+			SELECT command, timestamp,
+				ROW_NUMBER() OVER (PARTITION BY command ORDER BY timestamp DESC, id DESC) AS occurrence,
+				COUNT(*) OVER (PARTITION BY command) AS uses,
+				SUM(score) OVER (PARTITION BY command) AS total
+			FROM matched
+		)
+		SELECT command, timestamp, uses, CAST(total AS REAL) / SUM(total) OVER ()
+		FROM grouped
+		WHERE occurrence = 1
+		ORDER BY total DESC, timestamp DESC
+		LIMIT ?`
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query suggestions: %w", err)
+	}
+	defer rows.Close()
+
+	suggestions := []Suggestion{}
+	for rows.Next() {
+		var s Suggestion
+		if err := rows.Scan(&s.Command, &s.LastUsed, &s.Count, &s.Score); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		suggestions = append(suggestions, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during row iteration: %w", err)
+	}
+
+	return suggestions, nil
+}
+
+// adjacentEntry returns an SQL subquery for the ID of the entry run in the
+// same shell right before the entry whose ID is the SQL expression id, or
+// right after it if next is set. It is looked up through the sequence index.
+func adjacentEntry(id string, next bool) string {
+	cmp, order := "<", "DESC"
+	if next {
+		cmp, order = ">", "ASC"
+	}
+	return `(
+		SELECT a.id FROM history e
+		JOIN history a ON a.hostname = e.hostname AND a.process_id = e.process_id
+		WHERE e.id = ` + id + ` AND (a.timestamp, a.id) ` + cmp + ` (e.timestamp, e.id)
+		ORDER BY a.timestamp ` + order + `, a.id ` + order + `
+		LIMIT 1
+	)`
+}
+
+// lastCommands returns the last commands run by a shell, oldest first
+func (db *DB) lastCommands(ctx context.Context, hostname string, processID int) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT command FROM history
+		WHERE hostname = ? AND process_id = ?
+		ORDER BY timestamp DESC, id DESC
+		LIMIT ?`,
+		hostname, processID, suggestContext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query previous commands: %w", err)
+	}
+	defer rows.Close()
+
+	var commands []string
+	for rows.Next() {
+		var command string
+		if err := rows.Scan(&command); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		commands = append([]string{command}, commands...)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during row iteration: %w", err)
+	}
+
+	return commands, nil
+}
@@ -0,0 +1,185 @@
+package histree
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tableColumns are the header of the CSV and TSV formats
+var tableColumns = []string{"timestamp", "directory", "exit_code", "duration_ms", "hostname", "process_id", "session_id", "command"}
+
+// displayColumns are the header of the HTML and Markdown formats
+var displayColumns = []string{"Time", "Directory", "Exit", "Duration", "Command"}
+
+// tsvEscaper escapes the characters that would break a TSV row
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// markdownEscaper escapes the characters that would break a Markdown table
+// cell
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, "|", `\|`, "\r\n", "<br>", "\n", "<br>")
+
+// tableRow returns the values of entry for tableColumns. The duration is
+// empty if unknown.
+func tableRow(entry HistoryEntry) []string {
+	duration := ""
+	if entry.StartedAt != nil || entry.Duration > 0 {
+		duration = strconv.FormatInt(entry.Duration.Milliseconds(), 10)
+	}
+	return []string{
+		entry.Timestamp.UTC().Format(time.RFC3339Nano),
+		entry.Directory,
+		strconv.Itoa(entry.ExitCode),
+		duration,
+		entry.Hostname,
+		strconv.Itoa(entry.ProcessID),
+		entry.SessionID,
+		entry.Command,
+	}
+}
+
+// displayRow returns the values of entry for displayColumns, formatted like
+// the verbose format
+func displayRow(entry HistoryEntry) []string {
+	exitCode := ""
+	if entry.ExitCode != ExitCodeUnknown {
+		exitCode = strconv.Itoa(entry.ExitCode)
+	}
+	duration := ""
+	if entry.Duration > 0 {
+		duration = FormatDuration(entry.Duration)
+	}
+	return []string{
+		entry.Timestamp.Local().Format("2006-01-02T15:04:05"),
+		entry.Directory,
+		exitCode,
+		duration,
+		entry.Command,
+	}
+}
+
+// csvFormatter writes entries as CSV with a header row
+type csvFormatter struct {
+	w *csv.Writer
+}
+
+func (f *csvFormatter) Begin(w io.Writer) error {
+	f.w = csv.NewWriter(w)
+	return f.write(tableColumns)
+}
+
+func (f *csvFormatter) WriteEntry(w io.Writer, entry HistoryEntry) error {
+	return f.write(tableRow(entry))
+}
+
+func (f *csvFormatter) End(w io.Writer) error {
+	return nil
+}
+
+// write writes a record through to the underlying writer
+func (f *csvFormatter) write(record []string) error {
+	if err := f.w.Write(record); err != nil {
+		return fmt.Errorf("failed to write CSV: %w", err)
+	}
+	f.w.Flush()
+	if err := f.w.Error(); err != nil {
+		return fmt.Errorf("failed to write CSV: %w", err)
+	}
+	return nil
+}
+
+// tsvFormatter writes entries as tab-separated values with a header row
+type tsvFormatter struct{}
+
+func (tsvFormatter) Begin(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "%s\n", strings.Join(tableColumns, "\t")); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	return nil
+}
+
+func (tsvFormatter) WriteEntry(w io.Writer, entry HistoryEntry) error {
+	row := tableRow(entry)
+	for i, value := range row {
+		row[i] = tsvEscaper.Replace(value)
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", strings.Join(row, "\t")); err != nil {
+		return fmt.Errorf("failed to write entry: %w", err)
+	}
+	return nil
+}
+
+func (tsvFormatter) End(w io.Writer) error {
+	return nil
+}
+
+// htmlFormatter writes entries as an HTML table
+type htmlFormatter struct{}
+
+func (htmlFormatter) Begin(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("<table>\n<thead>\n<tr>")
+	for _, column := range displayColumns {
+		b.WriteString("<th>" + column + "</th>")
+	}
+	b.WriteString("</tr>\n</thead>\n<tbody>\n")
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	return nil
+}
+
+func (htmlFormatter) WriteEntry(w io.Writer, entry HistoryEntry) error {
+	row := displayRow(entry)
+	var b strings.Builder
+	b.WriteString("<tr>")
+	for i, value := range row {
+		value = html.EscapeString(value)
+		if i == len(row)-1 {
+			value = "<code>" + value + "</code>"
+		}
+		b.WriteString("<td>" + value + "</td>")
+	}
+	b.WriteString("</tr>\n")
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return fmt.Errorf("failed to write entry: %w", err)
+	}
+	return nil
+}
+
+func (htmlFormatter) End(w io.Writer) error {
+	if _, err := io.WriteString(w, "</tbody>\n</table>\n"); err != nil {
+		return fmt.Errorf("failed to write footer: %w", err)
+	}
+	return nil
+}
+
+// markdownFormatter writes entries as a Markdown table
+type markdownFormatter struct{}
+
+func (markdownFormatter) Begin(w io.Writer) error {
+	header := "| " + strings.Join(displayColumns, " | ") + " |\n| --- | --- | ---: | ---: | --- |\n"
+	if _, err := io.WriteString(w, header); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	return nil
+}
+
+func (markdownFormatter) WriteEntry(w io.Writer, entry HistoryEntry) error {
+	row := displayRow(entry)
+	for i, value := range row {
+		row[i] = markdownEscaper.Replace(value)
+	}
+	if _, err := fmt.Fprintf(w, "| %s |\n", strings.Join(row, " | ")); err != nil {
+		return fmt.Errorf("failed to write entry: %w", err)
+	}
+	return nil
+}
+
+func (markdownFormatter) End(w io.Writer) error {
+	return nil
+}
@@ -0,0 +1,118 @@
+package histree
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// colors are the ANSI escape codes of the names accepted by the color
+// template function
+var colors = map[string]string{
+	"bold":    "1",
+	"dim":     "2",
+	"red":     "31",
+	"green":   "32",
+	"yellow":  "33",
+	"blue":    "34",
+	"magenta": "35",
+	"cyan":    "36",
+	"white":   "37",
+}
+
+// templateFuncs are the helper functions available to output templates
+var templateFuncs = template.FuncMap{
+	"date":     formatDate,
+	"ago":      formatAgo,
+	"tilde":    shortenHome,
+	"color":    colorize,
+	"duration": FormatDuration,
+}
+
+// templateFormatter writes each entry by executing a template
+type templateFormatter struct {
+	tmpl *template.Template
+}
+
+// NewTemplateFormatter returns a Formatter executing a text/template for
+// each entry, followed by a newline. It is stateless, so it can be shared
+// between outputs. Besides the HistoryEntry fields,
+// templates can use these functions:
+//
+//	date LAYOUT TIME    formats a time with a time.Format layout
+//	ago TIME            how long ago a time was, e.g. "5m ago"
+//	tilde PATH          replaces the home directory prefix with ~
+//	color NAME TEXT     wraps text in an ANSI colour or style: bold, dim,
+//	                    red, green, yellow, blue, magenta, cyan or white
+//	duration DURATION   formats a duration like the verbose format
+//
+// For example: {{.Timestamp.Local | date "15:04"}} {{.ExitCode}} {{.Command}}
+func NewTemplateFormatter(text string) (Formatter, error) {
+	tmpl, err := template.New("entry").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %w", err)
+	}
+	return &templateFormatter{tmpl: tmpl}, nil
+}
+
+// Begin writes nothing
+func (f *templateFormatter) Begin(w io.Writer) error {
+	return nil
+}
+
+// WriteEntry executes the template for entry
+func (f *templateFormatter) WriteEntry(w io.Writer, entry HistoryEntry) error {
+	if err := f.tmpl.Execute(w, entry); err != nil {
+		return fmt.Errorf("failed to execute template: %w", err)
+	}
+	if _, err := io.WriteString(w, "\n"); err != nil {
+		return fmt.Errorf("failed to write entry: %w", err)
+	}
+	return nil
+}
+
+// End writes nothing
+func (f *templateFormatter) End(w io.Writer) error {
+	return nil
+}
+
+// formatDate formats t with layout; its argument order suits pipelines
+func formatDate(layout string, t time.Time) string {
+	return t.Format(layout)
+}
+
+// formatAgo describes how long ago t was in its largest unit
+func formatAgo(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d/time.Minute))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d/time.Hour))
+	default:
+		return fmt.Sprintf("%dd ago", int(d/(24*time.Hour)))
+	}
+}
+
+// shortenHome replaces the home directory prefix of path with ~
+func shortenHome(path string) string {
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" || !isUnder(path, home) {
+		return path
+	}
+	return "~" + strings.TrimPrefix(path, home)
+}
+
+// colorize wraps text in the ANSI escape code of a colour or style name
+func colorize(name, text string) (string, error) {
+	code, ok := colors[name]
+	if !ok {
+		return "", fmt.Errorf("unknown color: %s", name)
+	}
+	return "\x1b[" + code + "m" + text + "\x1b[0m", nil
+}
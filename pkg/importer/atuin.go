@@ -0,0 +1,73 @@
+package importer
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fuba/histree-core/pkg/histree"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ReadAtuin reads the history database of atuin, which records the
+// directory, exit code, duration and host of each command. Deleted
+// commands are skipped.
+func ReadAtuin(ctx context.Context, path string) ([]histree.HistoryEntry, error) {
+	db, err := sql.Open("sqlite3", "file:"+(&url.URL{Path: path}).EscapedPath()+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open atuin database: %w", err)
+	}
+	defer db.Close()
+
+	// Older atuin versions delete commands instead of marking them
+	var marked bool
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) > 0 FROM pragma_table_info('history') WHERE name = 'deleted_at'").Scan(&marked)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read atuin database: %w", err)
+	}
+	query := "SELECT timestamp, duration, exit, command, cwd, hostname FROM history"
+	if marked {
+		query += " WHERE deleted_at IS NULL"
+	}
+	query += " ORDER BY timestamp"
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read atuin database: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []histree.HistoryEntry
+	for rows.Next() {
+		var (
+			start, duration int64
+			entry           histree.HistoryEntry
+		)
+		if err := rows.Scan(&start, &duration, &entry.ExitCode, &entry.Command, &entry.Directory, &entry.Hostname); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		// Timestamps and durations are in nanoseconds; a negative duration
+		// is unknown
+		startedAt := time.Unix(0, start).UTC()
+		entry.Timestamp = startedAt
+		if duration >= 0 {
+			entry.Timestamp = startedAt.Add(time.Duration(duration))
+			entry.StartedAt = &startedAt
+			entry.Duration = time.Duration(duration)
+		}
+
+		// Hosts are recorded as "hostname:username"
+		entry.Hostname, _, _ = strings.Cut(entry.Hostname, ":")
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during row iteration: %w", err)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,83 @@
+package importer
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fuba/histree-core/pkg/histree"
+)
+
+// TestReadAtuin tests reading atuin databases with and without deletion
+// marks
+func TestReadAtuin(t *testing.T) {
+	const (
+		schema = `CREATE TABLE history (
+			id TEXT PRIMARY KEY,
+			timestamp INTEGER NOT NULL,
+			duration INTEGER NOT NULL,
+			exit INTEGER NOT NULL,
+			command TEXT NOT NULL,
+			cwd TEXT NOT NULL,
+			session TEXT NOT NULL,
+			hostname TEXT NOT NULL`
+		insert = `INSERT INTO history (id, timestamp, duration, exit, command, cwd, session, hostname) VALUES
+			('b', 1700000060000000000, -1, 1, 'false', '/tmp', 's', 'host:me'),
+			('a', 1700000000000000000, 1500000000, 0, 'make', '/src/app', 's', 'host:me')`
+	)
+
+	// Commands keep the directory, exit code and host atuin recorded
+	built := timed("make", 1700000000, 1500*time.Millisecond)
+	built.Directory, built.ExitCode, built.Hostname = "/src/app", 0, "host"
+	failed := at("false", 1700000060)
+	failed.Directory, failed.ExitCode, failed.Hostname = "/tmp", 1, "host"
+
+	tests := []struct {
+		name    string
+		queries []string
+		want    []histree.HistoryEntry
+	}{
+		{
+			name:    "without deletion marks",
+			queries: []string{schema + ")", insert},
+			want:    []histree.HistoryEntry{built, failed},
+		},
+		{
+			name: "deleted commands",
+			queries: []string{
+				schema + ", deleted_at INTEGER)",
+				insert,
+				"UPDATE history SET deleted_at = 1700000120000000000 WHERE id = 'b'",
+			},
+			want: []histree.HistoryEntry{built},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "history.db")
+			db, err := sql.Open("sqlite3", path)
+			if err != nil {
+				t.Fatalf("Failed to open database: %v", err)
+			}
+			for _, query := range tt.queries {
+				if _, err := db.Exec(query); err != nil {
+					t.Fatalf("Failed to set up database: %v", err)
+				}
+			}
+			db.Close()
+
+			got, err := ReadAtuin(context.Background(), path)
+			if err != nil {
+				t.Fatalf("Failed to read atuin database: %v", err)
+			}
+			checkEntries(t, got, tt.want)
+		})
+	}
+
+	if _, err := ReadAtuin(context.Background(), filepath.Join(t.TempDir(), "missing.db")); err == nil {
+		t.Error("Expected an error for a missing database")
+	}
+}
@@ -0,0 +1,64 @@
+package importer
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fuba/histree-core/pkg/histree"
+)
+
+// ParseBash parses a bash history file. When HISTTIMEFORMAT was set, each
+// command follows a "#<unix time>" line and may span several lines;
+// otherwise every line is a command with an unknown time.
+func ParseBash(r io.Reader) ([]histree.HistoryEntry, error) {
+	var (
+		entries   []histree.HistoryEntry
+		timestamp time.Time
+		lines     []string
+		timed     bool
+	)
+	flush := func() {
+		if command := strings.Join(lines, "\n"); strings.TrimSpace(command) != "" {
+			entries = append(entries, newEntry(command, timestamp))
+		}
+		lines = nil
+	}
+
+	scanner := newScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if t, ok := parseBashTimestamp(line); ok {
+			flush()
+			timestamp, timed = t, true
+			continue
+		}
+		if !timed {
+			timestamp = UnknownTime
+			lines = []string{line}
+			flush()
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read bash history: %w", err)
+	}
+	flush()
+
+	return entries, nil
+}
+
+// parseBashTimestamp parses a "#<unix time>" history line
+func parseBashTimestamp(line string) (time.Time, bool) {
+	if len(line) < 2 || line[0] != '#' {
+		return time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(line[1:], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0).UTC(), true
+}
@@ -0,0 +1,54 @@
+package importer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fuba/histree-core/pkg/histree"
+)
+
+// TestParseBash tests parsing bash histories with and without timestamps
+func TestParseBash(t *testing.T) {
+	tests := []parserTest{
+		{
+			name:    "plain",
+			history: "ls\n\ncd /tmp\n",
+			want:    []histree.HistoryEntry{at("ls", -1), at("cd /tmp", -1)},
+		},
+		{
+			name:    "timestamps",
+			history: "#1700000000\nls\n#1700000060\ncd /tmp\n",
+			want:    []histree.HistoryEntry{at("ls", 1700000000), at("cd /tmp", 1700000060)},
+		},
+		{
+			name:    "multiline command",
+			history: "#1700000000\nfor f in *; do\n  echo $f\ndone\n#1700000060\nls",
+			want:    []histree.HistoryEntry{at("for f in *; do\n  echo $f\ndone", 1700000000), at("ls", 1700000060)},
+		},
+		{
+			name:    "comment commands",
+			history: "#1700000000\n# not a timestamp\n#\n#12ab\n",
+			want:    []histree.HistoryEntry{at("# not a timestamp\n#\n#12ab", 1700000000)},
+		},
+		{
+			name:    "timestamp without command",
+			history: "#1700000000\n#1700000060\nls\n#1700000120\n",
+			want:    []histree.HistoryEntry{at("ls", 1700000060)},
+		},
+		{
+			name:    "commands before the first timestamp",
+			history: "ls\n#1700000000\npwd\n",
+			want:    []histree.HistoryEntry{at("ls", -1), at("pwd", 1700000000)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseBash(strings.NewReader(tt.history))
+			if err != nil {
+				t.Fatalf("Failed to parse: %v", err)
+			}
+			checkEntries(t, got, tt.want)
+		})
+	}
+}
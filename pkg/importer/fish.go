@@ -0,0 +1,71 @@
+package importer
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fuba/histree-core/pkg/histree"
+)
+
+// ParseFish parses a fish history file, a YAML-like list of "- cmd:"
+// items with a "when:" time each
+func ParseFish(r io.Reader) ([]histree.HistoryEntry, error) {
+	var entries []histree.HistoryEntry
+
+	scanner := newScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if command, ok := cutPrefix(line, "- cmd: "); ok {
+			entries = append(entries, newEntry(unescapeFish(command), UnknownTime))
+			continue
+		}
+		when, ok := cutPrefix(line, "  when: ")
+		if !ok || len(entries) == 0 {
+			continue
+		}
+		if sec, err := strconv.ParseInt(strings.TrimSpace(when), 10, 64); err == nil {
+			entries[len(entries)-1].Timestamp = time.Unix(sec, 0).UTC()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read fish history: %w", err)
+	}
+
+	return entries, nil
+}
+
+// unescapeFish decodes the newlines and backslashes fish escapes in
+// history commands
+func unescapeFish(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case 'n':
+				b.WriteByte('\n')
+				i++
+				continue
+			case '\\':
+				b.WriteByte('\\')
+				i++
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// cutPrefix returns s without prefix and whether s had it
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
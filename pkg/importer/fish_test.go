@@ -0,0 +1,49 @@
+package importer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fuba/histree-core/pkg/histree"
+)
+
+// TestParseFish tests parsing fish histories
+func TestParseFish(t *testing.T) {
+	tests := []parserTest{
+		{
+			name:    "commands",
+			history: "- cmd: ls\n  when: 1700000000\n- cmd: cd /tmp\n  when: 1700000060\n",
+			want:    []histree.HistoryEntry{at("ls", 1700000000), at("cd /tmp", 1700000060)},
+		},
+		{
+			name:    "multiline command",
+			history: "- cmd: for f in *\\n  echo $f\\nend\n  when: 1700000000\n",
+			want:    []histree.HistoryEntry{at("for f in *\n  echo $f\nend", 1700000000)},
+		},
+		{
+			name:    "escaped backslashes",
+			history: "- cmd: echo a\\\\nb \\t\n  when: 1700000000\n",
+			want:    []histree.HistoryEntry{at("echo a\\nb \\t", 1700000000)},
+		},
+		{
+			name:    "paths",
+			history: "- cmd: vim a.txt\n  when: 1700000000\n  paths:\n    - a.txt\n- cmd: ls\n  when: 1700000060\n",
+			want:    []histree.HistoryEntry{at("vim a.txt", 1700000000), at("ls", 1700000060)},
+		},
+		{
+			name:    "missing or malformed time",
+			history: "  when: 1700000000\n- cmd: ls\n- cmd: pwd\n  when: soon\n",
+			want:    []histree.HistoryEntry{at("ls", -1), at("pwd", -1)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFish(strings.NewReader(tt.history))
+			if err != nil {
+				t.Fatalf("Failed to parse: %v", err)
+			}
+			checkEntries(t, got, tt.want)
+		})
+	}
+}
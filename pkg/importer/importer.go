@@ -0,0 +1,106 @@
+// Package importer reads the histories of other shells and tools into
+// histree entries
+package importer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fuba/histree-core/pkg/histree"
+)
+
+// Format is a history format that can be imported
+type Format string
+
+const (
+	// FormatBash is a bash history file, with #timestamp lines when
+	// HISTTIMEFORMAT was set
+	FormatBash Format = "bash"
+	// FormatZsh is a zsh history file, in the plain or extended format
+	FormatZsh Format = "zsh"
+	// FormatFish is a fish history file
+	FormatFish Format = "fish"
+	// FormatAtuin is an atuin history database
+	FormatAtuin Format = "atuin"
+)
+
+// UnknownTime is the timestamp of imported commands whose history does not
+// record when they were run. It sorts them before every recorded command.
+var UnknownTime = time.Unix(0, 0).UTC()
+
+// maxLineSize is the longest history line the parsers accept
+const maxLineSize = 16 << 20
+
+// Read returns the commands of the history at path, oldest first.
+// Directories, exit codes and timestamps the format does not record are
+// left empty, set to histree.ExitCodeUnknown and set to UnknownTime.
+func Read(ctx context.Context, format Format, path string) ([]histree.HistoryEntry, error) {
+	var parse func(io.Reader) ([]histree.HistoryEntry, error)
+	switch format {
+	case FormatBash:
+		parse = ParseBash
+	case FormatZsh:
+		parse = ParseZsh
+	case FormatFish:
+		parse = ParseFish
+	case FormatAtuin:
+		return ReadAtuin(ctx, path)
+	default:
+		return nil, fmt.Errorf("unknown history format: %s", format)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history: %w", err)
+	}
+	defer f.Close()
+
+	return parse(f)
+}
+
+// DefaultPath returns where the history of format is kept by default
+func DefaultPath(format Format) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+
+	switch format {
+	case FormatBash:
+		return filepath.Join(home, ".bash_history"), nil
+	case FormatZsh:
+		return filepath.Join(home, ".zsh_history"), nil
+	case FormatFish:
+		return filepath.Join(dataHome, "fish", "fish_history"), nil
+	case FormatAtuin:
+		return filepath.Join(dataHome, "atuin", "history.db"), nil
+	default:
+		return "", fmt.Errorf("unknown history format: %s", format)
+	}
+}
+
+// newEntry returns an entry for an imported command with an unknown
+// directory and exit code
+func newEntry(command string, timestamp time.Time) histree.HistoryEntry {
+	return histree.HistoryEntry{
+		Command:   command,
+		Timestamp: timestamp,
+		ExitCode:  histree.ExitCodeUnknown,
+	}
+}
+
+// newScanner returns a line scanner accepting long multiline commands
+func newScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	return scanner
+}
@@ -0,0 +1,48 @@
+package importer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fuba/histree-core/pkg/histree"
+)
+
+// parserTest is a history file and the entries it should be parsed into
+type parserTest struct {
+	name    string
+	history string
+	want    []histree.HistoryEntry
+}
+
+// at returns an imported entry run at the given unix time, or at an unknown
+// time if sec is negative
+func at(command string, sec int64) histree.HistoryEntry {
+	if sec < 0 {
+		return newEntry(command, UnknownTime)
+	}
+	return newEntry(command, time.Unix(sec, 0).UTC())
+}
+
+// timed returns an imported entry that started at the given unix time and
+// ran for the given duration
+func timed(command string, sec int64, duration time.Duration) histree.HistoryEntry {
+	startedAt := time.Unix(sec, 0).UTC()
+	entry := newEntry(command, startedAt.Add(duration))
+	entry.StartedAt = &startedAt
+	entry.Duration = duration
+	return entry
+}
+
+// checkEntries reports the differences between parsed and expected entries
+func checkEntries(t *testing.T, got, want []histree.HistoryEntry) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d entries, got %d: %+v", len(want), len(got), got)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("Entry %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
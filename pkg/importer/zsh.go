@@ -0,0 +1,89 @@
+package importer
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fuba/histree-core/pkg/histree"
+)
+
+// zshMeta is the byte zsh writes before a metafied byte
+const zshMeta = 0x83
+
+// ParseZsh parses a zsh history file. Lines in the extended format
+// (": <start>:<elapsed>;<command>") carry the start time and duration of
+// the command; plain lines have an unknown time. A line ending with a
+// backslash continues on the next line.
+func ParseZsh(r io.Reader) ([]histree.HistoryEntry, error) {
+	var entries []histree.HistoryEntry
+
+	scanner := newScanner(r)
+	for scanner.Scan() {
+		line := unmetafy(scanner.Text())
+		for strings.HasSuffix(line, `\`) && scanner.Scan() {
+			line = line[:len(line)-1] + "\n" + unmetafy(scanner.Text())
+		}
+
+		entry, ok := parseZshExtended(line)
+		if !ok {
+			entry = newEntry(line, UnknownTime)
+		}
+		if strings.TrimSpace(entry.Command) != "" {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read zsh history: %w", err)
+	}
+
+	return entries, nil
+}
+
+// parseZshExtended parses an extended history line
+func parseZshExtended(line string) (histree.HistoryEntry, bool) {
+	if !strings.HasPrefix(line, ": ") {
+		return histree.HistoryEntry{}, false
+	}
+	header, command, ok := strings.Cut(line[2:], ";")
+	if !ok {
+		return histree.HistoryEntry{}, false
+	}
+	start, elapsed, ok := strings.Cut(header, ":")
+	if !ok {
+		return histree.HistoryEntry{}, false
+	}
+	sec, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return histree.HistoryEntry{}, false
+	}
+	secs, err := strconv.ParseInt(elapsed, 10, 64)
+	if err != nil {
+		return histree.HistoryEntry{}, false
+	}
+
+	startedAt := time.Unix(sec, 0).UTC()
+	entry := newEntry(command, startedAt.Add(time.Duration(secs)*time.Second))
+	entry.StartedAt = &startedAt
+	entry.Duration = time.Duration(secs) * time.Second
+	return entry, true
+}
+
+// unmetafy decodes the bytes zsh escapes in its history file
+func unmetafy(s string) string {
+	if strings.IndexByte(s, zshMeta) < 0 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == zshMeta && i+1 < len(s) {
+			i++
+			b = append(b, s[i]^32)
+			continue
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
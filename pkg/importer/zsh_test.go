@@ -0,0 +1,65 @@
+package importer
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fuba/histree-core/pkg/histree"
+)
+
+// TestParseZsh tests parsing plain and extended zsh histories
+func TestParseZsh(t *testing.T) {
+	tests := []parserTest{
+		{
+			name:    "plain",
+			history: "ls\n\ncd /tmp\n",
+			want:    []histree.HistoryEntry{at("ls", -1), at("cd /tmp", -1)},
+		},
+		{
+			name:    "extended",
+			history: ": 1700000000:0;ls\n: 1700000060:5;make\n",
+			want:    []histree.HistoryEntry{timed("ls", 1700000000, 0), timed("make", 1700000060, 5*time.Second)},
+		},
+		{
+			name:    "semicolons in the command",
+			history: ": 1700000000:0;cd /tmp; ls\n",
+			want:    []histree.HistoryEntry{timed("cd /tmp; ls", 1700000000, 0)},
+		},
+		{
+			name:    "continuation lines",
+			history: ": 1700000000:1;for f in *; do\\\n  echo $f\\\ndone\n: 1700000060:0;ls\n",
+			want:    []histree.HistoryEntry{timed("for f in *; do\n  echo $f\ndone", 1700000000, time.Second), timed("ls", 1700000060, 0)},
+		},
+		{
+			name:    "continuation at the end of the file",
+			history: "echo \\",
+			want:    []histree.HistoryEntry{at("echo \\", -1)},
+		},
+		{
+			name:    "metafied bytes",
+			history: ": 1700000000:0;echo \xe3\x83\xa3\xbc\n",
+			want:    []histree.HistoryEntry{timed("echo \u30fc", 1700000000, 0)},
+		},
+		{
+			name:    "malformed header",
+			history: ": 17000x:0;ls\n: 1700000000;ls\n",
+			want:    []histree.HistoryEntry{at(": 17000x:0;ls", -1), at(": 1700000000;ls", -1)},
+		},
+		{
+			name:    "empty command",
+			history: ": 1700000000:0;\n",
+			want:    nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseZsh(strings.NewReader(tt.history))
+			if err != nil {
+				t.Fatalf("Failed to parse: %v", err)
+			}
+			checkEntries(t, got, tt.want)
+		})
+	}
+}